@@ -1,3 +1,5 @@
 module github.com/AM-SAPP/buildapi
 
 go 1.18
+
+require github.com/gorilla/mux v1.8.1
@@ -2,11 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -27,7 +30,15 @@ type Author struct {
 }
 
 // fake DB
-var courses []Course
+
+type CourseStore struct {
+	mutex   sync.Mutex
+	courses []Course
+}
+
+func NewCourseStore(courses ...Course) *CourseStore {
+	return &CourseStore{courses: courses}
+}
 
 //
 
@@ -36,19 +47,51 @@ func (c *Course) IsEmpty() bool {
 	return c.CourseName == ""
 }
 
-func main() {
+// decodeCourse reads a single course from a request body.
+// A missing body is errNoBody, a body holding {} is errEmptyCourse.
+
+var (
+	errNoBody      = errors.New("please send some data")
+	errEmptyCourse = errors.New("no data inside")
+)
+
+func decodeCourse(body io.Reader) (Course, error) {
+	var course Course
+	if body == nil {
+		return course, errNoBody
+	}
+	if err := json.NewDecoder(body).Decode(&course); err != nil && err != io.EOF {
+		return course, err
+	}
+	if course.IsEmpty() {
+		return course, errEmptyCourse
+	}
+	return course, nil
+}
+
+// NewRouter wires every route of the API to the given store,
+// so the same router can be served by main or driven from a test.
+
+func NewRouter(store *CourseStore) *mux.Router {
 	r := mux.NewRouter()
 
-	courses = append(courses, Course{CourseId: "2", CourseName: "Reactjs", CoursePrice: 299, Author: &Author{Fullname: "Nikhil Singh", Website: "onefourth.com"}})
-	courses = append(courses, Course{CourseId: "3", CourseName: "MERN STACK", CoursePrice: 199, Author: &Author{Fullname: "Nikhil Singh", Website: "onefourthmain.com"}})
 	r.HandleFunc("/", serveHome).Methods("GET")
-	r.HandleFunc("/courses", getAllCourses).Methods("GET")
-	r.HandleFunc("/course/{id}", getOneCourse).Methods("GET")
-	r.HandleFunc("/course", createOneCourse).Methods("POST")
-	r.HandleFunc("/course/{id}", updateOneCourse).Methods("PUT")
-	r.HandleFunc("/course/{id}", deleteOneCourse).Methods("DELETE")
+	r.HandleFunc("/courses", store.getAllCourses).Methods("GET")
+	r.HandleFunc("/course/{id}", store.getOneCourse).Methods("GET")
+	r.HandleFunc("/course", store.createOneCourse).Methods("POST")
+	r.HandleFunc("/course/{id}", store.updateOneCourse).Methods("PUT")
+	r.HandleFunc("/course/{id}", store.deleteOneCourse).Methods("DELETE")
 
-	log.Fatal(http.ListenAndServe(":4000", r))
+	return r
+}
+
+func main() {
+	store := NewCourseStore(
+		Course{CourseId: "2", CourseName: "Reactjs", CoursePrice: 299, Author: &Author{Fullname: "Nikhil Singh", Website: "onefourth.com"}},
+		Course{CourseId: "3", CourseName: "MERN STACK", CoursePrice: 199, Author: &Author{Fullname: "Nikhil Singh", Website: "onefourthmain.com"}},
+	)
+
+	log.Fatal(http.ListenAndServe(":4000", NewRouter(store)))
 }
 
 // controllers
@@ -59,13 +102,16 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("<h1> Welcome to API by Onefourth.com </h1>"))
 }
 
-func getAllCourses(w http.ResponseWriter, r *http.Request) {
+func (s *CourseStore) getAllCourses(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("Get All Courses")
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(courses)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	json.NewEncoder(w).Encode(s.courses)
 }
 
-func getOneCourse(w http.ResponseWriter, r *http.Request) {
+func (s *CourseStore) getOneCourse(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("Get one Course")
 	w.Header().Set("Content-Type", "application/json")
 
@@ -74,7 +120,9 @@ func getOneCourse(w http.ResponseWriter, r *http.Request) {
 
 	// loop through the courses , find matching id and return the response
 
-	for _, course := range courses {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, course := range s.courses {
 		if course.CourseId == params["id"] {
 			json.NewEncoder(w).Encode(course)
 			return
@@ -85,25 +133,31 @@ func getOneCourse(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func createOneCourse(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Create one Course")
-	w.Header().Set("Content-Type", "application/json")
-
-	// What if : Body is empty
+// writeDecodeError answers with 400 when the body could not be decoded
+// and reports whether the handler should carry on.
 
-	if r.Body == nil {
+func writeDecodeError(w http.ResponseWriter, err error) bool {
+	if err == nil {
+		return true
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	if err == errNoBody {
 		json.NewEncoder(w).Encode("Please send some data")
-		return
+	} else {
+		json.NewEncoder(w).Encode("No data inside")
 	}
+	return false
+}
 
-	var course Course
+func (s *CourseStore) createOneCourse(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Create one Course")
+	w.Header().Set("Content-Type", "application/json")
 
+	// What if : Body is empty
 	// What if Body is {}
 
-	_ = json.NewDecoder(r.Body).Decode(&course)
-
-	if course.IsEmpty() {
-		json.NewEncoder(w).Encode("No data inside")
+	course, err := decodeCourse(r.Body)
+	if !writeDecodeError(w, err) {
 		return
 	}
 
@@ -112,26 +166,36 @@ func createOneCourse(w http.ResponseWriter, r *http.Request) {
 
 	rand.Seed(time.Now().UnixNano())
 	course.CourseId = strconv.Itoa(rand.Intn(100))
-	courses = append(courses, course)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.courses = append(s.courses, course)
 	json.NewEncoder(w).Encode(course)
 }
 
-func updateOneCourse(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Create one Course")
+func (s *CourseStore) updateOneCourse(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Update one Course")
 	w.Header().Set("Content-Type", "application/json")
 
 	// first grab id from req
 	params := mux.Vars(r)
 
+	// decode first, so a bad body leaves the course untouched
+	updated, err := decodeCourse(r.Body)
+	if !writeDecodeError(w, err) {
+		return
+	}
+
 	// loop , id  ,remove , add with my ID
 
-	for index, course := range courses {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for index, course := range s.courses {
 		if course.CourseId == params["id"] {
-			courses = append(courses[:index], courses[index+1:]...)
-			var course Course
-			_ = json.NewDecoder(r.Body).Decode(&course)
+			s.courses = append(s.courses[:index], s.courses[index+1:]...)
+			course := updated
 			course.CourseId = params["id"]
-			courses = append(courses, course)
+			s.courses = append(s.courses, course)
 			json.NewEncoder(w).Encode(course)
 			return
 		}
@@ -142,17 +206,19 @@ func updateOneCourse(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func deleteOneCourse(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Create one Course")
+func (s *CourseStore) deleteOneCourse(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Delete one Course")
 	w.Header().Set("Content-Type", "application/json")
 
 	params := mux.Vars(r)
 
 	// loop , id , remove
 
-	for index, course := range courses {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for index, course := range s.courses {
 		if course.CourseId == params["id"] {
-			courses = append(courses[:index], courses[index+1:]...)
+			s.courses = append(s.courses[:index], s.courses[index+1:]...)
 			json.NewEncoder(w).Encode("Deleted course with id : " + params["id"])
 			return
 		}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func newTestStore() *CourseStore {
+	return NewCourseStore(
+		Course{CourseId: "2", CourseName: "Reactjs", CoursePrice: 299, Author: &Author{Fullname: "Nikhil Singh", Website: "onefourth.com"}},
+		Course{CourseId: "3", CourseName: "MERN STACK", CoursePrice: 199, Author: &Author{Fullname: "Nikhil Singh", Website: "onefourthmain.com"}},
+	)
+}
+
+// createOneCourse picks a random id, so it is masked before comparing.
+
+var randomID = regexp.MustCompile(`"courseid":"\d+"`)
+
+func TestRoutes(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		mask   bool
+	}{
+		{"home", "GET", "/", "", http.StatusOK, false},
+		{"get_all", "GET", "/courses", "", http.StatusOK, false},
+		{"get_one", "GET", "/course/2", "", http.StatusOK, false},
+		{"get_one_missing", "GET", "/course/99", "", http.StatusOK, false},
+		{"create", "POST", "/course", `{"coursename":"Go","price":99,"author":{"fullname":"Gopher"}}`, http.StatusOK, true},
+		{"create_no_body", "POST", "/course", "", http.StatusBadRequest, false},
+		{"create_empty_object", "POST", "/course", `{}`, http.StatusBadRequest, false},
+		{"create_bad_json", "POST", "/course", `{"coursename":`, http.StatusBadRequest, false},
+		{"update", "PUT", "/course/3", `{"coursename":"MERN","price":149}`, http.StatusOK, false},
+		{"update_no_body", "PUT", "/course/3", "", http.StatusBadRequest, false},
+		{"update_bad_json", "PUT", "/course/3", `{"coursename":`, http.StatusBadRequest, false},
+		{"update_missing", "PUT", "/course/99", `{"coursename":"MERN"}`, http.StatusOK, false},
+		{"delete", "DELETE", "/course/2", "", http.StatusOK, false},
+		{"delete_missing", "DELETE", "/course/99", "", http.StatusOK, false},
+		{"wrong_method", "PATCH", "/course/2", "", http.StatusMethodNotAllowed, false},
+		{"unknown_route", "GET", "/nothing", "", http.StatusNotFound, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var request *http.Request
+			if test.body == "" {
+				request = httptest.NewRequest(test.method, test.path, nil)
+			} else {
+				request = httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+			}
+			recorder := httptest.NewRecorder()
+			NewRouter(newTestStore()).ServeHTTP(recorder, request)
+
+			if recorder.Code != test.status {
+				t.Errorf("status = %v, want %v", recorder.Code, test.status)
+			}
+			got := recorder.Body.Bytes()
+			if test.mask {
+				got = randomID.ReplaceAll(got, []byte(`"courseid":"<id>"`))
+			}
+			golden := filepath.Join("testdata", test.name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run go test -update to create it)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("body does not match %v\ngot:  %s\nwant: %s", golden, got, want)
+			}
+		})
+	}
+}
+
+// The handlers above each get a fresh store; this checks that changes
+// made through the router are seen by later requests.
+
+func TestStoreChangesPersist(t *testing.T) {
+	router := NewRouter(newTestStore())
+	send := func(method, path, body string) string {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return recorder.Body.String()
+	}
+	send("DELETE", "/course/2", "")
+	if got := send("GET", "/course/2", ""); !strings.Contains(got, "No course found") {
+		t.Errorf("deleted course still returned: %v", got)
+	}
+	send("PUT", "/course/3", `{"coursename":"MERN","price":149}`)
+	if got := send("GET", "/course/3", ""); !strings.Contains(got, `"coursename":"MERN"`) {
+		t.Errorf("update not stored: %v", got)
+	}
+	send("PUT", "/course/3", `{"coursename":`)
+	if got := send("GET", "/course/3", ""); !strings.Contains(got, `"coursename":"MERN","price":149`) {
+		t.Errorf("malformed update changed the course: %v", got)
+	}
+}
+
+func TestDecodeCourse(t *testing.T) {
+	if _, err := decodeCourse(nil); err != errNoBody {
+		t.Errorf("nil body: got %v, want errNoBody", err)
+	}
+	if _, err := decodeCourse(strings.NewReader("{}")); err != errEmptyCourse {
+		t.Errorf("{}: got %v, want errEmptyCourse", err)
+	}
+	course, err := decodeCourse(strings.NewReader(`{"coursename":"Go","price":5}`))
+	if err != nil || course.CourseName != "Go" || course.CoursePrice != 5 {
+		t.Errorf("got %+v, %v", course, err)
+	}
+}
+
+func FuzzDecodeCourse(f *testing.F) {
+	f.Add(`{"courseid":"1","coursename":"Go","price":10,"author":{"fullname":"A","website":"b"}}`)
+	f.Add(`{}`)
+	f.Add(``)
+	f.Add(`{"coursename":`)
+	f.Add(`[1,2,3]`)
+	f.Add(`{"price":"ten"}`)
+	f.Fuzz(func(t *testing.T, body string) {
+		course, err := decodeCourse(strings.NewReader(body))
+		if err == nil && course.IsEmpty() {
+			t.Errorf("accepted an empty course from %q", body)
+		}
+	})
+}
@@ -0,0 +1,264 @@
+// Package channels has generic helpers for combining, splitting and pacing
+// channels. Every function takes a context; its output channels are closed
+// once the input is exhausted or the context is cancelled, whichever comes
+// first, and nothing polls - goroutines only wake when a value or the
+// cancellation arrives.
+package channels
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+)
+
+func send[T any](ctx context.Context, out chan<- T, value T) bool {
+	select {
+	case out <- value:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// receive waits for the next value from in. It reports false once in is
+// closed or ctx is cancelled.
+
+func receive[T any](ctx context.Context, in <-chan T) (T, bool) {
+	select {
+	case value, ok := <-in:
+		return value, ok
+	case <-ctx.Done():
+		var zero T
+		return zero, false
+	}
+}
+
+// Merge forwards values from all of chans onto a single channel, which is
+// closed after every input has been closed.
+
+func Merge[T any](ctx context.Context, chans ...<-chan T) <-chan T {
+	out := make(chan T)
+	var wg sync.WaitGroup
+	for _, ch := range chans {
+		wg.Add(1)
+		go func(ch <-chan T) {
+			defer wg.Done()
+			for {
+				value, ok := receive(ctx, ch)
+				if !ok || !send(ctx, out, value) {
+					return
+				}
+			}
+		}(ch)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// Tee copies every value from in to n outputs. A value is not taken from
+// in until all outputs have received the previous one, so the slowest
+// reader sets the pace. With n of zero or less in is drained and
+// discarded.
+
+func Tee[T any](ctx context.Context, in <-chan T, n int) []<-chan T {
+	outs := make([]chan T, max(n, 0))
+	for i := range outs {
+		outs[i] = make(chan T)
+	}
+	go func() {
+		defer closeAll(outs)
+		for {
+			value, ok := receive(ctx, in)
+			if !ok {
+				return
+			}
+			for _, out := range outs {
+				if !send(ctx, out, value) {
+					return
+				}
+			}
+		}
+	}()
+	return receiveOnly(outs)
+}
+
+type Distribution int
+
+const (
+	RoundRobin Distribution = iota
+	LeastLoaded
+)
+
+// FanOut hands each value from in to exactly one of n outputs, each
+// buffered to hold bufferSize values. RoundRobin takes the outputs in
+// turn; LeastLoaded picks the one with the fewest values waiting and, if
+// all are full, whichever frees up first. With n of zero or less there is
+// nowhere to send values, so no outputs are returned and in is left
+// unread.
+
+func FanOut[T any](ctx context.Context, in <-chan T, n, bufferSize int, distribution Distribution) []<-chan T {
+	if n <= 0 {
+		return []<-chan T{}
+	}
+	outs := make([]chan T, n)
+	for i := range outs {
+		outs[i] = make(chan T, max(bufferSize, 0))
+	}
+	go func() {
+		defer closeAll(outs)
+		next := 0
+		for {
+			value, ok := receive(ctx, in)
+			if !ok {
+				return
+			}
+			if distribution == LeastLoaded {
+				ok = sendLeastLoaded(ctx, outs, value)
+			} else {
+				ok = send(ctx, outs[next], value)
+				next = (next + 1) % n
+			}
+			if !ok {
+				return
+			}
+		}
+	}()
+	return receiveOnly(outs)
+}
+
+func sendLeastLoaded[T any](ctx context.Context, outs []chan T, value T) bool {
+	least := 0
+	for i, out := range outs {
+		if len(out) < len(outs[least]) {
+			least = i
+		}
+	}
+	if len(outs[least]) < cap(outs[least]) {
+		outs[least] <- value
+		return true
+	}
+	cases := make([]reflect.SelectCase, 0, len(outs)+1)
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv,
+		Chan: reflect.ValueOf(ctx.Done())})
+	for _, out := range outs {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectSend,
+			Chan: reflect.ValueOf(out), Send: reflect.ValueOf(value)})
+	}
+	chosen, _, _ := reflect.Select(cases)
+	return chosen != 0
+}
+
+// Batch groups values into slices of up to size, emitting a shorter batch
+// when maxWait has passed since the first value in it arrived. A partial
+// batch is flushed when in is closed.
+
+func Batch[T any](ctx context.Context, in <-chan T, size int, maxWait time.Duration) <-chan []T {
+	out := make(chan []T)
+	go func() {
+		defer close(out)
+		var batch []T
+		timer := time.NewTimer(maxWait)
+		timer.Stop()
+		flush := func() bool {
+			timer.Stop()
+			if len(batch) == 0 {
+				return true
+			}
+			ok := send(ctx, out, batch)
+			batch = nil
+			return ok
+		}
+		for {
+			select {
+			case value, ok := <-in:
+				if !ok {
+					flush()
+					return
+				}
+				if len(batch) == 0 {
+					timer.Reset(maxWait)
+				}
+				batch = append(batch, value)
+				if len(batch) >= size && !flush() {
+					return
+				}
+			case <-timer.C:
+				if !flush() {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// Throttle passes values on no faster than rate per second. After a quiet
+// spell a single value goes through straight away; there is no burst
+// allowance beyond that. A rate that isn't positive, or is too high to
+// measure in nanoseconds, turns throttling off.
+
+func Throttle[T any](ctx context.Context, in <-chan T, rate float64) <-chan T {
+	out := make(chan T)
+	if !(rate > 0) || float64(time.Second)/rate < 1 {
+		go func() {
+			defer close(out)
+			for {
+				value, ok := receive(ctx, in)
+				if !ok || !send(ctx, out, value) {
+					return
+				}
+			}
+		}()
+		return out
+	}
+	interval := time.Duration(float64(time.Second) / rate)
+	go func() {
+		defer close(out)
+		// The wait is measured from the last send rather than kept by a
+		// ticker, which would save up a tick while the input is idle.
+		timer := time.NewTimer(interval)
+		if !timer.Stop() {
+			<-timer.C
+		}
+		var last time.Time
+		for {
+			value, ok := receive(ctx, in)
+			if !ok {
+				return
+			}
+			if wait := time.Until(last.Add(interval)); wait > 0 {
+				timer.Reset(wait)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if !send(ctx, out, value) {
+				return
+			}
+			last = time.Now()
+		}
+	}()
+	return out
+}
+
+func closeAll[T any](chans []chan T) {
+	for _, ch := range chans {
+		close(ch)
+	}
+}
+
+func receiveOnly[T any](chans []chan T) []<-chan T {
+	result := make([]<-chan T, len(chans))
+	for i, ch := range chans {
+		result[i] = ch
+	}
+	return result
+}
@@ -0,0 +1,261 @@
+package channels
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+const waitLimit = 2 * time.Second
+
+func source(values ...int) <-chan int {
+	ch := make(chan int, len(values))
+	for _, value := range values {
+		ch <- value
+	}
+	close(ch)
+	return ch
+}
+
+// collect reads ch until it is closed, failing the test if that takes
+// longer than waitLimit.
+
+func collect[T any](t *testing.T, ch <-chan T) []T {
+	t.Helper()
+	var values []T
+	timeout := time.After(waitLimit)
+	for {
+		select {
+		case value, ok := <-ch:
+			if !ok {
+				return values
+			}
+			values = append(values, value)
+		case <-timeout:
+			t.Fatalf("channel not closed, got %v so far", values)
+		}
+	}
+}
+
+func collectAll[T any](t *testing.T, chans []<-chan T) [][]T {
+	t.Helper()
+	results := make([][]T, len(chans))
+	done := make(chan struct{})
+	for i, ch := range chans {
+		go func(i int, ch <-chan T) {
+			for value := range ch {
+				results[i] = append(results[i], value)
+			}
+			done <- struct{}{}
+		}(i, ch)
+	}
+	timeout := time.After(waitLimit)
+	for range chans {
+		select {
+		case <-done:
+		case <-timeout:
+			t.Fatal("outputs not closed")
+		}
+	}
+	return results
+}
+
+func TestMerge(t *testing.T) {
+	ctx := context.Background()
+	values := collect(t, Merge(ctx, source(1, 2, 3), source(), source(4, 5)))
+	sort.Ints(values)
+	if !reflect.DeepEqual(values, []int{1, 2, 3, 4, 5}) {
+		t.Errorf("got %v", values)
+	}
+	if values := collect(t, Merge[int](ctx)); len(values) != 0 {
+		t.Errorf("no inputs: got %v", values)
+	}
+}
+
+func TestTee(t *testing.T) {
+	results := collectAll(t, Tee(context.Background(), source(1, 2, 3), 3))
+	for i, values := range results {
+		if !reflect.DeepEqual(values, []int{1, 2, 3}) {
+			t.Errorf("output %d: got %v", i, values)
+		}
+	}
+	for _, n := range []int{0, -1} {
+		in := source(1, 2)
+		if outs := Tee(context.Background(), in, n); len(outs) != 0 {
+			t.Errorf("n=%d: %d outputs", n, len(outs))
+		}
+		deadline := time.Now().Add(waitLimit)
+		for len(in) > 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if len(in) != 0 {
+			t.Errorf("n=%d: input not drained", n)
+		}
+	}
+}
+
+func TestFanOutRoundRobin(t *testing.T) {
+	outs := FanOut(context.Background(), source(1, 2, 3, 4, 5, 6, 7), 3, 4, RoundRobin)
+	results := collectAll(t, outs)
+	want := [][]int{{1, 4, 7}, {2, 5}, {3, 6}}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("got %v, want %v", results, want)
+	}
+}
+
+func TestFanOutLeastLoaded(t *testing.T) {
+	in := make(chan int)
+	outs := FanOut(context.Background(), in, 2, 2, LeastLoaded)
+	for i := 1; i <= 5; i++ {
+		in <- i
+	}
+	// 1 to 4 alternate and fill both outputs, so 5 waits for whichever
+	// output makes room first.
+	got := []int{<-outs[1]}
+	close(in)
+	got = append(got, collect(t, outs[1])...)
+	if !reflect.DeepEqual(got, []int{2, 4, 5}) {
+		t.Errorf("second output got %v, want [2 4 5]", got)
+	}
+	if first := collect(t, outs[0]); !reflect.DeepEqual(first, []int{1, 3}) {
+		t.Errorf("first output got %v, want [1 3]", first)
+	}
+}
+
+func TestFanOutWithoutOutputs(t *testing.T) {
+	for _, n := range []int{0, -2} {
+		in := source(1)
+		for _, distribution := range []Distribution{RoundRobin, LeastLoaded} {
+			if outs := FanOut(context.Background(), in, n, 1, distribution); len(outs) != 0 {
+				t.Errorf("n=%d: %d outputs", n, len(outs))
+			}
+		}
+		if len(in) != 1 {
+			t.Errorf("n=%d: input was read", n)
+		}
+	}
+	outs := FanOut(context.Background(), source(1, 2), 1, -1, RoundRobin)
+	if values := collect(t, outs[0]); !reflect.DeepEqual(values, []int{1, 2}) {
+		t.Errorf("negative buffer size: got %v", values)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	batches := collect(t, Batch(context.Background(), source(1, 2, 3, 4, 5), 2, time.Hour))
+	want := [][]int{{1, 2}, {3, 4}, {5}}
+	if !reflect.DeepEqual(batches, want) {
+		t.Errorf("got %v, want %v", batches, want)
+	}
+
+	in := make(chan int)
+	out := Batch(context.Background(), in, 10, 20*time.Millisecond)
+	in <- 1
+	in <- 2
+	select {
+	case batch := <-out:
+		if !reflect.DeepEqual(batch, []int{1, 2}) {
+			t.Errorf("partial batch %v", batch)
+		}
+	case <-time.After(waitLimit):
+		t.Fatal("partial batch not flushed after maxWait")
+	}
+	close(in)
+	if rest := collect(t, out); len(rest) != 0 {
+		t.Errorf("empty batch flushed on close: %v", rest)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	start := time.Now()
+	values := collect(t, Throttle(context.Background(), source(1, 2, 3, 4), 50))
+	if !reflect.DeepEqual(values, []int{1, 2, 3, 4}) {
+		t.Errorf("got %v", values)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("4 values at 50/s took only %v", elapsed)
+	}
+}
+
+// TestThrottleAfterIdle sends values with quiet spells in between; the
+// value after each one may go at once, but the next must still wait a
+// whole interval.
+
+func TestThrottleAfterIdle(t *testing.T) {
+	in := make(chan int)
+	out := Throttle(context.Background(), in, 10)
+	var times []time.Time
+	for round := 0; round < 3; round++ {
+		time.Sleep(250 * time.Millisecond)
+		for i := 0; i < 2; i++ {
+			go func() { in <- i }()
+			<-out
+			times = append(times, time.Now())
+		}
+	}
+	close(in)
+	for i := 1; i < len(times); i++ {
+		if gap := times[i].Sub(times[i-1]); gap < 95*time.Millisecond {
+			t.Errorf("gap %d was %v, want at least 100ms", i, gap)
+		}
+	}
+}
+
+func TestThrottleWithoutLimit(t *testing.T) {
+	for _, rate := range []float64{0, -1, 1e12} {
+		values := collect(t, Throttle(context.Background(), source(1, 2, 3), rate))
+		if !reflect.DeepEqual(values, []int{1, 2, 3}) {
+			t.Errorf("rate %v: got %v", rate, values)
+		}
+	}
+}
+
+// TestCancelClosesOutputs checks that every function closes its outputs
+// when ctx is cancelled, even though the input is still open and idle.
+
+func TestCancelClosesOutputs(t *testing.T) {
+	tests := map[string]func(ctx context.Context, in <-chan int) []<-chan int{
+		"Merge": func(ctx context.Context, in <-chan int) []<-chan int {
+			return []<-chan int{Merge(ctx, in, make(chan int))}
+		},
+		"Tee": func(ctx context.Context, in <-chan int) []<-chan int {
+			return Tee(ctx, in, 2)
+		},
+		"FanOut": func(ctx context.Context, in <-chan int) []<-chan int {
+			return FanOut(ctx, in, 2, 1, RoundRobin)
+		},
+		"FanOutLeastLoaded": func(ctx context.Context, in <-chan int) []<-chan int {
+			return FanOut(ctx, in, 2, 1, LeastLoaded)
+		},
+		"Throttle": func(ctx context.Context, in <-chan int) []<-chan int {
+			return []<-chan int{Throttle(ctx, in, 10)}
+		},
+		"ThrottleWithoutLimit": func(ctx context.Context, in <-chan int) []<-chan int {
+			return []<-chan int{Throttle(ctx, in, 0)}
+		},
+		"Batch": func(ctx context.Context, in <-chan int) []<-chan int {
+			return []<-chan int{countBatches(Batch(ctx, in, 2, time.Hour))}
+		},
+	}
+	for name, start := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			in := make(chan int)
+			outs := start(ctx, in)
+			cancel()
+			collectAll(t, outs)
+		})
+	}
+}
+
+func countBatches(in <-chan []int) <-chan int {
+	out := make(chan int)
+	go func() {
+		defer close(out)
+		for batch := range in {
+			out <- len(batch)
+		}
+	}()
+	return out
+}
@@ -0,0 +1,337 @@
+package channels
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+var ErrClosed = errors.New("channel is closed")
+
+// OverflowPolicy decides what Send does when the buffer is full.
+
+type OverflowPolicy int
+
+const (
+	// Block waits for the consumer to make room.
+	Block OverflowPolicy = iota
+	// DropNewest discards the value being sent.
+	DropNewest
+	// DropOldest discards the value that has waited longest, so the buffer
+	// behaves as a ring holding the most recent values.
+	DropOldest
+	// SpillToDisk writes values to a temporary file as JSON until the
+	// consumer catches up. Nothing is lost and order is kept, but values
+	// must survive a JSON round trip.
+	SpillToDisk
+)
+
+func (policy OverflowPolicy) String() string {
+	switch policy {
+	case Block:
+		return "block"
+	case DropNewest:
+		return "drop newest"
+	case DropOldest:
+		return "drop oldest"
+	case SpillToDisk:
+		return "spill to disk"
+	}
+	return "unknown"
+}
+
+// OverflowStats counts every value passed to Send as Sent, whether it was
+// then delivered, dropped or is still pending. Spilled values are counted
+// again when delivered. Values still pending when ctx is cancelled are
+// counted as dropped.
+
+type OverflowStats struct {
+	Sent      uint64
+	Delivered uint64
+	Dropped   uint64
+	Spilled   uint64
+	Pending   int
+}
+
+// Overflow is a buffered channel with a choice of what happens when the
+// buffer fills up. Producers call Send and Close; consumers range over Out.
+
+type Overflow[T any] struct {
+	ctx      context.Context
+	policy   OverflowPolicy
+	capacity int
+	out      chan T
+	ready    chan struct{}
+	space    chan struct{}
+	done     chan struct{}
+
+	mutex   sync.Mutex
+	queue   []T
+	spill   *spillFile[T]
+	closed  bool
+	handing bool
+	stats   OverflowStats
+}
+
+// NewOverflow creates an Overflow buffering up to capacity values in
+// memory. spillDir is only used by SpillToDisk; "" means os.TempDir.
+// Cancelling ctx closes Out straight away, for when the consumer has
+// gone, and discards whatever is still buffered.
+
+func NewOverflow[T any](ctx context.Context, capacity int, policy OverflowPolicy, spillDir string) (*Overflow[T], error) {
+	if capacity < 1 {
+		capacity = 1
+	}
+	overflow := &Overflow[T]{
+		ctx:      ctx,
+		policy:   policy,
+		capacity: capacity,
+		out:      make(chan T),
+		ready:    make(chan struct{}, 1),
+		space:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	if policy == SpillToDisk {
+		spill, err := newSpillFile[T](spillDir)
+		if err != nil {
+			return nil, err
+		}
+		overflow.spill = spill
+	}
+	go overflow.pump()
+	return overflow, nil
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Send offers a value, applying the policy if the buffer is full. Only the
+// Block policy waits, and only until ctx is cancelled.
+
+func (o *Overflow[T]) Send(ctx context.Context, value T) error {
+	for {
+		o.mutex.Lock()
+		if o.closed {
+			o.mutex.Unlock()
+			return ErrClosed
+		}
+		full := len(o.queue) >= o.capacity
+		switch {
+		case o.spill != nil && (full || o.spill.pending > 0):
+			// Once spilling has started, later values follow the spilled
+			// ones onto disk to keep the order.
+			if err := o.spill.write(value); err != nil {
+				o.mutex.Unlock()
+				return err
+			}
+			o.stats.Spilled++
+		case !full:
+			o.queue = append(o.queue, value)
+			if len(o.queue) < o.capacity {
+				// Pass the wake-up on to any other blocked sender.
+				signal(o.space)
+			}
+		case o.policy == DropNewest:
+			o.stats.Dropped++
+		case o.policy == DropOldest:
+			var zero T
+			o.queue[0] = zero
+			o.queue = append(o.queue[1:], value)
+			o.stats.Dropped++
+		default:
+			o.mutex.Unlock()
+			select {
+			case <-o.space:
+				continue
+			case <-o.done:
+				return ErrClosed
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		o.stats.Sent++
+		o.mutex.Unlock()
+		signal(o.ready)
+		return nil
+	}
+}
+
+func (o *Overflow[T]) Out() <-chan T {
+	return o.out
+}
+
+// Close stops further sends. Values already buffered or spilled are still
+// delivered before Out is closed.
+
+func (o *Overflow[T]) Close() {
+	o.mutex.Lock()
+	o.closed = true
+	o.mutex.Unlock()
+	signal(o.ready)
+}
+
+func (o *Overflow[T]) Stats() OverflowStats {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	stats := o.stats
+	stats.Pending = len(o.queue)
+	if o.handing {
+		stats.Pending++
+	}
+	if o.spill != nil {
+		stats.Pending += o.spill.pending
+	}
+	return stats
+}
+
+func (o *Overflow[T]) next() (value T, ok bool, done bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if len(o.queue) == 0 && o.spill != nil && o.spill.pending > 0 {
+		for len(o.queue) < o.capacity && o.spill.pending > 0 {
+			spilled, err := o.spill.read()
+			if err != nil {
+				// A damaged record cannot be delivered; count it as dropped.
+				o.stats.Dropped++
+				continue
+			}
+			o.queue = append(o.queue, spilled)
+		}
+	}
+	if len(o.queue) == 0 {
+		return value, false, o.closed
+	}
+	value = o.queue[0]
+	var zero T
+	o.queue[0] = zero
+	o.queue = o.queue[1:]
+	o.handing = true
+	return value, true, false
+}
+
+// pump hands values to Out one at a time. The value it is holding still
+// counts as pending until the consumer takes it.
+
+func (o *Overflow[T]) pump() {
+	defer func() {
+		if o.spill != nil {
+			o.spill.remove()
+		}
+		close(o.done)
+		close(o.out)
+	}()
+	for {
+		value, ok, done := o.next()
+		if done {
+			return
+		}
+		if !ok {
+			select {
+			case <-o.ready:
+				continue
+			case <-o.ctx.Done():
+				o.discard()
+				return
+			}
+		}
+		signal(o.space)
+		select {
+		case o.out <- value:
+		case <-o.ctx.Done():
+			o.discard()
+			return
+		}
+		o.mutex.Lock()
+		o.handing = false
+		o.stats.Delivered++
+		o.mutex.Unlock()
+	}
+}
+
+// discard closes the Overflow and counts everything still pending as
+// dropped.
+
+func (o *Overflow[T]) discard() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.closed = true
+	o.stats.Dropped += uint64(len(o.queue))
+	o.queue = nil
+	if o.handing {
+		o.handing = false
+		o.stats.Dropped++
+	}
+	if o.spill != nil {
+		o.stats.Dropped += uint64(o.spill.pending)
+		o.spill.pending = 0
+	}
+}
+
+// spillFile is an append-only JSON-lines file read back from the front.
+// It is emptied whenever the reader catches up with the writer.
+
+type spillFile[T any] struct {
+	file    *os.File
+	reader  *bufio.Reader
+	size    int64
+	pending int
+}
+
+func newSpillFile[T any](dir string) (*spillFile[T], error) {
+	file, err := os.CreateTemp(dir, "overflow-*.jsonl")
+	if err != nil {
+		return nil, err
+	}
+	return &spillFile[T]{file: file, reader: bufio.NewReader(file)}, nil
+}
+
+func (s *spillFile[T]) write(value T) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	// WriteAt leaves the file offset, which the reader uses, alone. A
+	// partial record is cut off again so the next one starts on a fresh
+	// line.
+	written, err := s.file.WriteAt(append(data, '\n'), s.size)
+	if err != nil {
+		s.file.Truncate(s.size)
+		return err
+	}
+	s.size += int64(written)
+	s.pending++
+	return nil
+}
+
+func (s *spillFile[T]) read() (value T, err error) {
+	line, err := s.reader.ReadBytes('\n')
+	s.pending--
+	if s.pending == 0 {
+		s.reset()
+	}
+	if err != nil {
+		return value, err
+	}
+	err = json.Unmarshal(line, &value)
+	return value, err
+}
+
+func (s *spillFile[T]) reset() {
+	s.file.Truncate(0)
+	s.size = 0
+	s.file.Seek(0, io.SeekStart)
+	s.reader.Reset(s.file)
+}
+
+func (s *spillFile[T]) remove() {
+	s.file.Close()
+	os.Remove(s.file.Name())
+}
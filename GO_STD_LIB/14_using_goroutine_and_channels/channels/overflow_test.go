@@ -0,0 +1,220 @@
+package channels
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// holding waits until the pump has taken a value and is blocked handing
+// it to Out, so the values sent next stay in the buffer.
+
+func holding[T any](t *testing.T, o *Overflow[T]) {
+	t.Helper()
+	deadline := time.Now().Add(waitLimit)
+	for time.Now().Before(deadline) {
+		o.mutex.Lock()
+		handing := o.handing
+		o.mutex.Unlock()
+		if handing {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("pump never took a value")
+}
+
+// fill sends 0 and waits for the pump to hold it, then sends 1 to n-1.
+
+func fill(t *testing.T, o *Overflow[int], n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := o.Send(context.Background(), i); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			holding(t, o)
+		}
+	}
+}
+
+func spillFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "overflow-*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	tests := []struct {
+		policy    OverflowPolicy
+		delivered []int
+		dropped   uint64
+	}{
+		{DropNewest, []int{0, 1, 2, 3}, 3},
+		{DropOldest, []int{0, 4, 5, 6}, 3},
+	}
+	for _, test := range tests {
+		o, err := NewOverflow[int](context.Background(), 3, test.policy, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fill(t, o, 7)
+		if stats := o.Stats(); stats.Pending != 4 || stats.Dropped != test.dropped {
+			t.Errorf("%v: before reading %+v", test.policy, stats)
+		}
+		o.Close()
+		if values := collect(t, o.Out()); !reflect.DeepEqual(values, test.delivered) {
+			t.Errorf("%v: got %v, want %v", test.policy, values, test.delivered)
+		}
+		want := OverflowStats{Sent: 7, Delivered: 4, Dropped: test.dropped}
+		if stats := o.Stats(); stats != want {
+			t.Errorf("%v: stats %+v, want %+v", test.policy, stats, want)
+		}
+	}
+}
+
+func TestOverflowBlock(t *testing.T) {
+	o, err := NewOverflow[int](context.Background(), 2, Block, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill(t, o, 3)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := o.Send(ctx, 3); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Send to a full buffer returned %v", err)
+	}
+	go func() {
+		for i := 3; i < 10; i++ {
+			o.Send(context.Background(), i)
+		}
+		o.Close()
+	}()
+	if values := collect(t, o.Out()); !reflect.DeepEqual(values, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}) {
+		t.Errorf("got %v", values)
+	}
+	if err := o.Send(context.Background(), 10); !errors.Is(err, ErrClosed) {
+		t.Errorf("Send after Close returned %v", err)
+	}
+}
+
+func TestOverflowSpillToDisk(t *testing.T) {
+	dir := t.TempDir()
+	o, err := NewOverflow[int](context.Background(), 2, SpillToDisk, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill(t, o, 10)
+	if stats := o.Stats(); stats.Spilled != 7 || stats.Pending != 10 || stats.Dropped != 0 {
+		t.Errorf("after spilling %+v", stats)
+	}
+	files := spillFiles(t, dir)
+	if len(files) != 1 {
+		t.Fatalf("spill files %v", files)
+	}
+	if data, _ := os.ReadFile(files[0]); bytes.Count(data, []byte("\n")) != 7 {
+		t.Errorf("spill file holds %q, want 7 records", data)
+	}
+
+	// Reading some values back must not let new ones jump the queue.
+	values := []int{<-o.Out(), <-o.Out(), <-o.Out(), <-o.Out()}
+	for i := 10; i < 13; i++ {
+		o.Send(context.Background(), i)
+	}
+	o.Close()
+	values = append(values, collect(t, o.Out())...)
+	if !reflect.DeepEqual(values, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}) {
+		t.Errorf("got %v", values)
+	}
+	want := OverflowStats{Sent: 13, Delivered: 13, Spilled: o.Stats().Spilled}
+	if stats := o.Stats(); stats != want || stats.Spilled < 7 {
+		t.Errorf("stats %+v", stats)
+	}
+	if files := spillFiles(t, dir); len(files) != 0 {
+		t.Errorf("spill file left behind: %v", files)
+	}
+}
+
+func TestOverflowCancel(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	o, err := NewOverflow[int](ctx, 2, SpillToDisk, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill(t, o, 6)
+	cancel()
+	if values := collect(t, o.Out()); len(values) != 0 {
+		t.Errorf("got %v after cancel", values)
+	}
+	if err := o.Send(context.Background(), 6); !errors.Is(err, ErrClosed) {
+		t.Errorf("Send after cancel returned %v", err)
+	}
+	want := OverflowStats{Sent: 6, Dropped: 6, Spilled: 3}
+	if stats := o.Stats(); stats != want {
+		t.Errorf("stats %+v, want %+v", stats, want)
+	}
+	if files := spillFiles(t, dir); len(files) != 0 {
+		t.Errorf("spill file left behind: %v", files)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	o, err = NewOverflow[int](ctx, 1, Block, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill(t, o, 2)
+	blocked := make(chan error)
+	go func() { blocked <- o.Send(context.Background(), 2) }()
+	cancel()
+	select {
+	case err := <-blocked:
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("blocked Send returned %v", err)
+		}
+	case <-time.After(waitLimit):
+		t.Fatal("blocked Send not released by cancel")
+	}
+}
+
+func TestSpillFileShortWrite(t *testing.T) {
+	spill, err := newSpillFile[string](t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spill.remove()
+	if err := spill.write("first"); err != nil {
+		t.Fatal(err)
+	}
+	size := spill.size
+	name := spill.file.Name()
+	// Swap in a read-only handle so the next write fails.
+	writable := spill.file
+	if spill.file, err = os.Open(name); err != nil {
+		t.Fatal(err)
+	}
+	if err := spill.write("second"); err == nil {
+		t.Fatal("write to a read-only file succeeded")
+	}
+	spill.file.Close()
+	spill.file = writable
+	if spill.size != size || spill.pending != 1 {
+		t.Errorf("after failed write: size %d pending %d, want %d and 1", spill.size, spill.pending, size)
+	}
+	if err := spill.write("third"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"first", "third"} {
+		if got, err := spill.read(); err != nil || got != want {
+			t.Errorf("read %q, %v; want %q", got, err, want)
+		}
+	}
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQueueClosed     = errors.New("dispatch queue is closed")
+	ErrUnknownDelivery = errors.New("no such delivery in flight")
+)
+
+// QueueOptions controls redelivery. A message that has not been acked
+// within VisibilityTimeout of being received is handed out again, and one
+// that has been delivered MaxDeliveries times without an ack is moved to
+// the dead-letter file instead.
+
+type QueueOptions struct {
+	VisibilityTimeout time.Duration
+	MaxDeliveries     int
+}
+
+type QueuedDispatch struct {
+	ID uint64
+	DispatchNotification
+	Delivery int
+}
+
+// A queuedMessage is reserved while the Channel adapter is waiting to
+// hand it over; its delivery and visibility timer only start once the
+// consumer has taken it.
+
+type queuedMessage struct {
+	id           uint64
+	notification DispatchNotification
+	deliveries   int
+	reserved     bool
+	inFlight     bool
+	timer        *time.Timer
+}
+
+// walRecord is one line of the write-ahead log. Every change is appended
+// and synced before it takes effect, so replaying the log after a crash
+// rebuilds the queue; messages that were in flight become ready again.
+
+type walRecord struct {
+	Op           string
+	ID           uint64
+	Notification *DispatchNotification `json:",omitempty"`
+	Deliveries   int                   `json:",omitempty"`
+}
+
+type deadLetter struct {
+	ID           uint64
+	Notification DispatchNotification
+	Deliveries   int
+	Time         time.Time
+}
+
+// DispatchQueue is a durable FIFO of DispatchNotifications backed by a
+// write-ahead log file, with a second file collecting dead letters.
+
+type DispatchQueue struct {
+	path       string
+	deadPath   string
+	options    QueueOptions
+	mutex      sync.Mutex
+	wal        *os.File
+	nextID     uint64
+	messages   map[uint64]*queuedMessage
+	ready      []uint64
+	readyChan  chan struct{}
+	sealed     bool
+	closed     bool
+	deadLetter *os.File
+}
+
+// OpenDispatchQueue replays the log at path, compacts it down to the
+// messages that are still outstanding and opens it for appending. Dead
+// letters go to the same path with a ".dead" suffix.
+
+func OpenDispatchQueue(path string, options QueueOptions) (*DispatchQueue, error) {
+	if options.VisibilityTimeout <= 0 {
+		options.VisibilityTimeout = 30 * time.Second
+	}
+	if options.MaxDeliveries < 1 {
+		options.MaxDeliveries = 5
+	}
+	queue := &DispatchQueue{
+		path:      path,
+		deadPath:  path + ".dead",
+		options:   options,
+		messages:  make(map[uint64]*queuedMessage),
+		readyChan: make(chan struct{}, 1),
+	}
+	if err := queue.replay(); err != nil {
+		return nil, err
+	}
+	if err := queue.compact(); err != nil {
+		return nil, err
+	}
+	wal, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	queue.wal = wal
+	dead, err := os.OpenFile(queue.deadPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		wal.Close()
+		return nil, err
+	}
+	queue.deadLetter = dead
+	if len(queue.ready) > 0 {
+		signal(queue.readyChan)
+	}
+	return queue, nil
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (q *DispatchQueue) replay() error {
+	file, err := os.Open(q.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record walRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A torn final line from a crash mid-write; everything before
+			// it was synced and is intact.
+			break
+		}
+		if record.ID >= q.nextID {
+			q.nextID = record.ID + 1
+		}
+		switch record.Op {
+		case "enqueue":
+			if record.Notification != nil {
+				notification := *record.Notification
+				if p, ok := findProduct(notification.Name); ok {
+					notification.Product = p
+				}
+				q.messages[record.ID] = &queuedMessage{id: record.ID,
+					notification: notification, deliveries: record.Deliveries}
+			}
+		case "deliver":
+			if message, ok := q.messages[record.ID]; ok {
+				message.deliveries++
+			}
+		case "ack", "dead":
+			delete(q.messages, record.ID)
+		}
+	}
+	for id := uint64(0); id < q.nextID; id++ {
+		if _, ok := q.messages[id]; ok {
+			q.ready = append(q.ready, id)
+		}
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the log with one enqueue record per outstanding
+// message, replacing the old file atomically.
+
+func (q *DispatchQueue) compact() error {
+	dir, name := filepath.Split(q.path)
+	if dir == "" {
+		dir = "."
+	}
+	temp, err := os.CreateTemp(dir, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	writer := bufio.NewWriter(temp)
+	encoder := json.NewEncoder(writer)
+	for _, id := range q.ready {
+		message := q.messages[id]
+		err = encoder.Encode(walRecord{Op: "enqueue", ID: id,
+			Notification: &message.notification, Deliveries: message.deliveries})
+		if err != nil {
+			temp.Close()
+			return err
+		}
+	}
+	if err = writer.Flush(); err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), q.path)
+}
+
+func (q *DispatchQueue) append(record walRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err = q.wal.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return q.wal.Sync()
+}
+
+// Enqueue returns once the notification is safely in the log.
+
+func (q *DispatchQueue) Enqueue(notification DispatchNotification) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.sealed || q.closed {
+		return ErrQueueClosed
+	}
+	id := q.nextID
+	err := q.append(walRecord{Op: "enqueue", ID: id, Notification: &notification})
+	if err != nil {
+		return err
+	}
+	q.nextID++
+	q.messages[id] = &queuedMessage{id: id, notification: notification}
+	q.ready = append(q.ready, id)
+	signal(q.readyChan)
+	return nil
+}
+
+// Receive waits for the next ready message and marks it in flight. It
+// returns ErrQueueClosed once the queue is sealed and nothing is ready.
+
+func (q *DispatchQueue) Receive(ctx context.Context) (QueuedDispatch, error) {
+	message, err := q.reserve(ctx)
+	if err != nil {
+		return QueuedDispatch{}, err
+	}
+	return q.deliver(message)
+}
+
+// reserve takes the next ready message off the queue, burying any that
+// have used up their deliveries, without starting a delivery.
+
+func (q *DispatchQueue) reserve(ctx context.Context) (*queuedMessage, error) {
+	for {
+		q.mutex.Lock()
+		for len(q.ready) > 0 && !q.closed {
+			message := q.messages[q.ready[0]]
+			q.ready = q.ready[1:]
+			if message == nil {
+				continue
+			}
+			if message.deliveries >= q.options.MaxDeliveries {
+				if err := q.bury(message); err != nil {
+					q.mutex.Unlock()
+					return nil, err
+				}
+				continue
+			}
+			message.reserved = true
+			if len(q.ready) > 0 {
+				signal(q.readyChan)
+			}
+			q.mutex.Unlock()
+			return message, nil
+		}
+		closed := q.sealed || q.closed
+		q.mutex.Unlock()
+		if closed {
+			// Wake the next waiting receiver so it sees the seal too.
+			signal(q.readyChan)
+			return nil, ErrQueueClosed
+		}
+		select {
+		case <-q.readyChan:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// deliver logs the delivery of a reserved message and starts its
+// visibility timer.
+
+func (q *DispatchQueue) deliver(message *queuedMessage) (QueuedDispatch, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.messages[message.id] != message || !message.reserved {
+		// Already acked or nacked by a consumer that was quicker than us.
+		return QueuedDispatch{}, nil
+	}
+	if err := q.start(message); err != nil {
+		return QueuedDispatch{}, err
+	}
+	return QueuedDispatch{ID: message.id,
+		DispatchNotification: message.notification, Delivery: message.deliveries}, nil
+}
+
+// start turns a reservation into a delivery. If the log can't be
+// written the message goes back to the front of the queue.
+
+func (q *DispatchQueue) start(message *queuedMessage) error {
+	message.reserved = false
+	if q.closed {
+		return ErrQueueClosed
+	}
+	if err := q.append(walRecord{Op: "deliver", ID: message.id}); err != nil {
+		q.ready = append([]uint64{message.id}, q.ready...)
+		signal(q.readyChan)
+		return err
+	}
+	message.deliveries++
+	message.inFlight = true
+	delivery := message.deliveries
+	message.timer = time.AfterFunc(q.options.VisibilityTimeout, func() {
+		q.expire(message.id, delivery)
+	})
+	return nil
+}
+
+// release hands back a reservation that was never delivered, keeping its
+// place at the front of the queue.
+
+func (q *DispatchQueue) release(message *queuedMessage) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.messages[message.id] == message && message.reserved {
+		message.reserved = false
+		q.ready = append([]uint64{message.id}, q.ready...)
+		signal(q.readyChan)
+	}
+}
+
+// expire puts a message back on the queue if the delivery that started
+// the timer is still unacknowledged.
+
+func (q *DispatchQueue) expire(id uint64, delivery int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if message, ok := q.messages[id]; ok && message.inFlight && message.deliveries == delivery {
+		message.inFlight = false
+		q.ready = append(q.ready, id)
+		signal(q.readyChan)
+	}
+}
+
+func (q *DispatchQueue) bury(message *queuedMessage) error {
+	data, err := json.Marshal(deadLetter{ID: message.id, Notification: message.notification,
+		Deliveries: message.deliveries, Time: time.Now()})
+	if err != nil {
+		return err
+	}
+	if _, err = q.deadLetter.Write(append(data, '\n')); err == nil {
+		err = q.deadLetter.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	if err = q.append(walRecord{Op: "dead", ID: message.id}); err != nil {
+		return err
+	}
+	delete(q.messages, message.id)
+	return nil
+}
+
+func (q *DispatchQueue) inFlight(id uint64) (*queuedMessage, error) {
+	if q.closed {
+		return nil, ErrQueueClosed
+	}
+	message, ok := q.messages[id]
+	if !ok || !(message.inFlight || message.reserved) {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownDelivery, id)
+	}
+	return message, nil
+}
+
+// Ack removes a delivered message for good.
+
+func (q *DispatchQueue) Ack(id uint64) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	message, err := q.inFlight(id)
+	if err != nil {
+		return err
+	}
+	if err = q.append(walRecord{Op: "ack", ID: id}); err != nil {
+		return err
+	}
+	if message.timer != nil {
+		message.timer.Stop()
+	}
+	delete(q.messages, id)
+	return nil
+}
+
+// Nack returns a delivered message to the back of the queue without
+// waiting for its visibility timeout. The failed delivery still counts
+// towards MaxDeliveries.
+
+func (q *DispatchQueue) Nack(id uint64) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	message, err := q.inFlight(id)
+	if err != nil {
+		return err
+	}
+	if message.reserved {
+		// Handed over but not logged yet; log it so the attempt counts.
+		if err := q.start(message); err != nil {
+			return err
+		}
+	}
+	message.timer.Stop()
+	message.inFlight = false
+	q.ready = append(q.ready, id)
+	signal(q.readyChan)
+	return nil
+}
+
+// QueueDelivery is a message handed out by Channel. The consumer calls
+// Ack when it has finished with it, or Nack to have it delivered again.
+
+type QueueDelivery struct {
+	QueuedDispatch
+	queue *DispatchQueue
+}
+
+func (d QueueDelivery) Ack() error {
+	return d.queue.Ack(d.ID)
+}
+
+func (d QueueDelivery) Nack() error {
+	return d.queue.Nack(d.ID)
+}
+
+// Channel adapts the queue for consumers that range over a channel. A
+// message is only delivered, and its visibility timeout only starts, when
+// the consumer takes it from the channel; until then it is held back from
+// other receivers. The channel closes once the queue is sealed and empty
+// or ctx is cancelled. After that, the returned function reports the
+// error that stopped it early, if there was one.
+
+func (q *DispatchQueue) Channel(ctx context.Context) (<-chan QueueDelivery, func() error) {
+	out := make(chan QueueDelivery)
+	var failure error
+	stopped := make(chan struct{})
+	go func() {
+		defer close(out)
+		defer close(stopped)
+		for {
+			message, err := q.reserve(ctx)
+			if err != nil {
+				if !errors.Is(err, ErrQueueClosed) && ctx.Err() == nil {
+					failure = err
+				}
+				return
+			}
+			q.mutex.Lock()
+			delivery := QueueDelivery{QueuedDispatch: QueuedDispatch{ID: message.id,
+				DispatchNotification: message.notification, Delivery: message.deliveries + 1},
+				queue: q}
+			q.mutex.Unlock()
+			select {
+			case out <- delivery:
+			case <-ctx.Done():
+				q.release(message)
+				return
+			}
+			if _, err := q.deliver(message); err != nil && !errors.Is(err, ErrQueueClosed) {
+				failure = err
+				return
+			}
+		}
+	}()
+	return out, func() error {
+		<-stopped
+		return failure
+	}
+}
+
+// Seal stops new enqueues. Receivers carry on until nothing is ready and
+// then get ErrQueueClosed, which ends the Channel adapter.
+
+func (q *DispatchQueue) Seal() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.sealed = true
+	signal(q.readyChan)
+}
+
+// Close releases the files. Anything not yet acked stays in the log and
+// is delivered again when the queue is next opened.
+
+func (q *DispatchQueue) Close() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	for _, message := range q.messages {
+		if message.timer != nil {
+			message.timer.Stop()
+		}
+	}
+	signal(q.readyChan)
+	err := q.wal.Close()
+	if deadErr := q.deadLetter.Close(); err == nil {
+		err = deadErr
+	}
+	return err
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func openTestQueue(t *testing.T, options QueueOptions) (*DispatchQueue, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "dispatches.wal")
+	queue, err := OpenDispatchQueue(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { queue.Close() })
+	return queue, path
+}
+
+func enqueueCustomers(t *testing.T, queue *DispatchQueue, customers ...string) {
+	t.Helper()
+	for _, customer := range customers {
+		if err := queue.Enqueue(DispatchNotification{Customer: customer,
+			Product: ProductList[0], Quantity: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestChannelStartsTimeoutAtHandOff has a consumer take most of the
+// visibility timeout over each message. Every message must be delivered
+// once and acked, because its timer only starts when it is taken.
+
+func TestChannelStartsTimeoutAtHandOff(t *testing.T) {
+	queue, path := openTestQueue(t, QueueOptions{VisibilityTimeout: 100 * time.Millisecond,
+		MaxDeliveries: 3})
+	enqueueCustomers(t, queue, "a", "b", "c", "d")
+	queue.Seal()
+
+	deliveries, channelErr := queue.Channel(context.Background())
+	var received []string
+	for delivery := range deliveries {
+		received = append(received, delivery.Customer)
+		time.Sleep(60 * time.Millisecond)
+		if err := delivery.Ack(); err != nil {
+			t.Errorf("ack %v: %v", delivery.Customer, err)
+		}
+		if delivery.Delivery != 1 {
+			t.Errorf("%v: delivery %d", delivery.Customer, delivery.Delivery)
+		}
+	}
+	if err := channelErr(); err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(received, []string{"a", "b", "c", "d"}) {
+		t.Errorf("received %v", received)
+	}
+	if dead, _ := os.ReadFile(path + ".dead"); len(dead) != 0 {
+		t.Errorf("dead letters: %s", dead)
+	}
+}
+
+func TestChannelRedelivers(t *testing.T) {
+	queue, _ := openTestQueue(t, QueueOptions{VisibilityTimeout: 30 * time.Millisecond,
+		MaxDeliveries: 2})
+	enqueueCustomers(t, queue, "nacked", "expired")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	deliveries, channelErr := queue.Channel(ctx)
+	var received []string
+	for delivery := range deliveries {
+		received = append(received, delivery.Customer)
+		switch {
+		case delivery.Customer == "nacked" && delivery.Delivery == 1:
+			if err := delivery.Nack(); err != nil {
+				t.Fatal(err)
+			}
+		case delivery.Customer == "expired" && delivery.Delivery == 1:
+			// Never acked; it comes back after the visibility timeout.
+		default:
+			delivery.Ack()
+		}
+		if len(received) == 4 {
+			cancel()
+		}
+	}
+	if err := channelErr(); err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(received, []string{"nacked", "expired", "nacked", "expired"}) {
+		t.Errorf("received %v", received)
+	}
+}
+
+func TestChannelCancelKeepsMessage(t *testing.T) {
+	queue, path := openTestQueue(t, QueueOptions{MaxDeliveries: 1})
+	enqueueCustomers(t, queue, "a")
+	ctx, cancel := context.WithCancel(context.Background())
+	deliveries, channelErr := queue.Channel(ctx)
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	for range deliveries {
+		t.Error("got a delivery after cancel")
+	}
+	if err := channelErr(); err != nil {
+		t.Error(err)
+	}
+	queue.Close()
+
+	// The reservation was never handed over, so it isn't a delivery and
+	// MaxDeliveries of 1 still allows one.
+	reopened, err := OpenDispatchQueue(path, QueueOptions{MaxDeliveries: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	reopened.Seal()
+	dispatch, err := reopened.Receive(context.Background())
+	if err != nil || dispatch.Customer != "a" || dispatch.Delivery != 1 {
+		t.Fatalf("Receive after reopen: %+v, %v", dispatch, err)
+	}
+	if err := reopened.Ack(dispatch.ID); err != nil {
+		t.Error(err)
+	}
+	if _, err := reopened.Receive(context.Background()); !errors.Is(err, ErrQueueClosed) {
+		t.Errorf("queue not empty: %v", err)
+	}
+}
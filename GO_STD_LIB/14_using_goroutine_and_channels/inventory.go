@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrUnknownReservation = errors.New("unknown reservation")
+	ErrBackordered        = errors.New("reservation is waiting on stock")
+)
+
+// StockAlert is sent when the stock available for new orders falls to or
+// below the product's threshold. It is sent once per crossing, not on
+// every order while the level stays low.
+
+type StockAlert struct {
+	Product   *Product
+	Available int
+	Threshold int
+}
+
+// Reservation holds stock for one order from acceptance until it is
+// dispatched or cancelled. Whatever could not be reserved straight away is
+// Backordered and is filled, oldest reservation first, as stock arrives.
+
+type Reservation struct {
+	ID uint64
+	DispatchNotification
+	Reserved    int
+	Backordered int
+}
+
+type StockLevel struct {
+	OnHand      int
+	Reserved    int
+	Backordered int
+	Threshold   int
+}
+
+// Available is the stock that is neither reserved nor already promised.
+
+func (level StockLevel) Available() int {
+	return level.OnHand - level.Reserved
+}
+
+type stockEntry struct {
+	StockLevel
+	alerted    bool
+	backorders []*Reservation
+}
+
+// Inventory tracks stock per Product. All methods are safe to call from
+// many goroutines at once.
+
+type Inventory struct {
+	mutex         sync.Mutex
+	stock         map[*Product]*stockEntry
+	reservations  map[uint64]*Reservation
+	nextID        uint64
+	alerts        chan StockAlert
+	droppedAlerts int
+}
+
+// NewInventory buffers up to alertBuffer alerts. Alerts are never allowed
+// to hold up an order, so when nobody is reading and the buffer is full
+// further alerts are counted in DroppedAlerts and discarded.
+
+func NewInventory(alertBuffer int) *Inventory {
+	return &Inventory{
+		stock:        make(map[*Product]*stockEntry),
+		reservations: make(map[uint64]*Reservation),
+		alerts:       make(chan StockAlert, alertBuffer),
+	}
+}
+
+func (inv *Inventory) Alerts() <-chan StockAlert {
+	return inv.alerts
+}
+
+func (inv *Inventory) DroppedAlerts() int {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+	return inv.droppedAlerts
+}
+
+// SetStock sets the quantity on hand and the low-stock threshold for a
+// product, adding it to the inventory if needed.
+
+func (inv *Inventory) SetStock(product *Product, onHand, threshold int) {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+	entry := inv.entry(product)
+	entry.OnHand = onHand
+	entry.Threshold = threshold
+	inv.fillBackorders(entry)
+	inv.checkLevel(product, entry)
+}
+
+func (inv *Inventory) entry(product *Product) *stockEntry {
+	entry, ok := inv.stock[product]
+	if !ok {
+		entry = &stockEntry{}
+		inv.stock[product] = entry
+	}
+	return entry
+}
+
+func (inv *Inventory) Level(product *Product) (StockLevel, bool) {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+	entry, ok := inv.stock[product]
+	if !ok {
+		return StockLevel{}, false
+	}
+	return entry.StockLevel, true
+}
+
+// unknownProductError names the product when there is one; a nil product
+// is never in the inventory either.
+
+func unknownProductError(product *Product) error {
+	if product == nil {
+		return fmt.Errorf("%w: no product given", ErrUnknownProduct)
+	}
+	return fmt.Errorf("%w: %v", ErrUnknownProduct, product.Name)
+}
+
+// Restock adds delivered stock, which goes to backorders first.
+
+func (inv *Inventory) Restock(product *Product, quantity int) error {
+	if quantity <= 0 {
+		return ErrInvalidQuantity
+	}
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+	entry, ok := inv.stock[product]
+	if !ok {
+		return unknownProductError(product)
+	}
+	entry.OnHand += quantity
+	inv.fillBackorders(entry)
+	inv.checkLevel(product, entry)
+	return nil
+}
+
+// Reserve sets stock aside for an accepted order. If there is not enough,
+// the shortfall is backordered rather than refused.
+
+func (inv *Inventory) Reserve(notification DispatchNotification) (Reservation, error) {
+	if notification.Quantity <= 0 {
+		return Reservation{}, ErrInvalidQuantity
+	}
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+	entry, ok := inv.stock[notification.Product]
+	if !ok {
+		return Reservation{}, unknownProductError(notification.Product)
+	}
+	inv.nextID++
+	reservation := &Reservation{ID: inv.nextID, DispatchNotification: notification}
+	reservation.Reserved = min(notification.Quantity, max(entry.Available(), 0))
+	reservation.Backordered = notification.Quantity - reservation.Reserved
+	entry.Reserved += reservation.Reserved
+	if reservation.Backordered > 0 {
+		entry.Backordered += reservation.Backordered
+		entry.backorders = append(entry.backorders, reservation)
+	}
+	inv.reservations[reservation.ID] = reservation
+	inv.checkLevel(notification.Product, entry)
+	return *reservation, nil
+}
+
+// Confirm takes reserved stock off the shelf when the order is
+// dispatched. A reservation still waiting on backordered stock cannot be
+// confirmed yet.
+
+func (inv *Inventory) Confirm(id uint64) error {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+	reservation, ok := inv.reservations[id]
+	if !ok {
+		return fmt.Errorf("%w: %v", ErrUnknownReservation, id)
+	}
+	if reservation.Backordered > 0 {
+		return fmt.Errorf("%w: %v of %v still backordered", ErrBackordered,
+			reservation.Backordered, reservation.Quantity)
+	}
+	entry := inv.stock[reservation.Product]
+	entry.OnHand -= reservation.Reserved
+	entry.Reserved -= reservation.Reserved
+	delete(inv.reservations, id)
+	return nil
+}
+
+// Release cancels a reservation, returning its stock to be reserved by
+// backorders or new orders.
+
+func (inv *Inventory) Release(id uint64) error {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+	reservation, ok := inv.reservations[id]
+	if !ok {
+		return fmt.Errorf("%w: %v", ErrUnknownReservation, id)
+	}
+	entry := inv.stock[reservation.Product]
+	entry.Reserved -= reservation.Reserved
+	if reservation.Backordered > 0 {
+		entry.Backordered -= reservation.Backordered
+		for i, backorder := range entry.backorders {
+			if backorder == reservation {
+				entry.backorders = append(entry.backorders[:i], entry.backorders[i+1:]...)
+				break
+			}
+		}
+	}
+	delete(inv.reservations, id)
+	inv.fillBackorders(entry)
+	inv.checkLevel(reservation.Product, entry)
+	return nil
+}
+
+// Reservation reports the current state of a reservation, which changes
+// as backorders are filled.
+
+func (inv *Inventory) Reservation(id uint64) (Reservation, bool) {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+	reservation, ok := inv.reservations[id]
+	if !ok {
+		return Reservation{}, false
+	}
+	return *reservation, true
+}
+
+func (inv *Inventory) fillBackorders(entry *stockEntry) {
+	for len(entry.backorders) > 0 && entry.Available() > 0 {
+		reservation := entry.backorders[0]
+		filled := min(reservation.Backordered, entry.Available())
+		reservation.Reserved += filled
+		reservation.Backordered -= filled
+		entry.Reserved += filled
+		entry.Backordered -= filled
+		if reservation.Backordered == 0 {
+			entry.backorders = entry.backorders[1:]
+		}
+	}
+}
+
+func (inv *Inventory) checkLevel(product *Product, entry *stockEntry) {
+	available := entry.Available()
+	if available > entry.Threshold {
+		entry.alerted = false
+		return
+	}
+	if entry.alerted {
+		return
+	}
+	entry.alerted = true
+	select {
+	case inv.alerts <- StockAlert{Product: product, Available: available, Threshold: entry.Threshold}:
+	default:
+		inv.droppedAlerts++
+	}
+}
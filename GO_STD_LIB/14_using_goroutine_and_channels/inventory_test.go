@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestInventoryUnknownProduct(t *testing.T) {
+	inv := NewInventory(1)
+	known, unknown := ProductList[0], ProductList[1]
+	inv.SetStock(known, 5, 1)
+
+	tests := map[string]func() error{
+		"Restock nil": func() error { return inv.Restock(nil, 1) },
+		"Reserve nil": func() error {
+			_, err := inv.Reserve(DispatchNotification{Customer: "Alice", Quantity: 1})
+			return err
+		},
+		"Restock unknown": func() error { return inv.Restock(unknown, 1) },
+		"Reserve unknown": func() error {
+			_, err := inv.Reserve(DispatchNotification{Customer: "Alice", Product: unknown, Quantity: 1})
+			return err
+		},
+	}
+	for name, call := range tests {
+		err := call()
+		if !errors.Is(err, ErrUnknownProduct) {
+			t.Errorf("%s: got %v, want ErrUnknownProduct", name, err)
+		}
+		if strings.HasSuffix(name, "unknown") && !strings.Contains(err.Error(), unknown.Name) {
+			t.Errorf("%s: %q does not name the product", name, err)
+		}
+	}
+	if level, _ := inv.Level(known); level.OnHand != 5 || level.Reserved != 0 {
+		t.Errorf("known product changed: %+v", level)
+	}
+}
+
+func TestInventoryBackorders(t *testing.T) {
+	inv := NewInventory(4)
+	product := ProductList[0]
+	inv.SetStock(product, 3, 1)
+
+	first, err := inv.Reserve(DispatchNotification{Customer: "Alice", Product: product, Quantity: 2})
+	if err != nil || first.Reserved != 2 || first.Backordered != 0 {
+		t.Fatalf("first reservation %+v, %v", first, err)
+	}
+	second, err := inv.Reserve(DispatchNotification{Customer: "Bob", Product: product, Quantity: 3})
+	if err != nil || second.Reserved != 1 || second.Backordered != 2 {
+		t.Fatalf("second reservation %+v, %v", second, err)
+	}
+	if alert := <-inv.Alerts(); alert.Product != product || alert.Available != 1 {
+		t.Errorf("alert %+v", alert)
+	}
+	if err := inv.Confirm(second.ID); !errors.Is(err, ErrBackordered) {
+		t.Errorf("confirming backordered reservation: %v", err)
+	}
+	if err := inv.Restock(product, 2); err != nil {
+		t.Fatal(err)
+	}
+	if filled, _ := inv.Reservation(second.ID); filled.Backordered != 0 || filled.Reserved != 3 {
+		t.Errorf("after restock %+v", filled)
+	}
+	if err := inv.Confirm(second.ID); err != nil {
+		t.Error(err)
+	}
+	if err := inv.Release(first.ID); err != nil {
+		t.Error(err)
+	}
+	if level, _ := inv.Level(product); level.OnHand != 2 || level.Reserved != 0 || level.Backordered != 0 {
+		t.Errorf("final level %+v", level)
+	}
+}
@@ -1,13 +1,32 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
 	"time"
+
+	"concurrency/channels"
 )
 
 func WhenNumberOfValuesAreKnown() {
-	CalcStoreTotal(Products)
+	storeTotal, err := CalcStoreTotal(context.Background(), Products,
+		AggregateOptions{Concurrency: 2, Timeout: time.Millisecond * 500})
+	for _, category := range storeTotal.Categories {
+		if category.Err != nil {
+			fmt.Println(category.Category, "failed:", category.Err)
+		} else {
+			fmt.Println(category.Category, category.Products, "products:", ToCurrency(category.Total))
+		}
+	}
+	fmt.Println("Total:", ToCurrency(storeTotal.Total))
+	if err != nil {
+		fmt.Println("Errors:", err)
+	}
 }
 
 func UsingForLoopForUnknownAmountOfValues() {
@@ -54,9 +73,9 @@ func MistakingOperations() {
 	fmt.Println("Order count:", orderCount)
 	for i := 0; i < orderCount; i++ {
 		channel <- DispatchNotification{
-			Customer: Customers[rand.Intn(len(Customers)-1)],
+			Customer: Customers[rand.Intn(len(Customers))],
 			Quantity: rand.Intn(10),
-			Product:  ProductList[rand.Intn(len(ProductList)-1)],
+			Product:  ProductList[rand.Intn(len(ProductList))],
 		}
 		if i == 1 {
 			notification := <-channel
@@ -177,6 +196,40 @@ func enumerateProductsForSending(channel chan<- *Product) {
 	close(channel)
 }
 
+// Unlike enumerateProductsForSending, what happens to products that don't
+// fit is chosen by the overflow policy, and drops are counted rather than
+// lost silently.
+
+func enumerateProductsWithOverflow(ctx context.Context, overflow *channels.Overflow[*Product]) {
+	for _, p := range ProductList {
+		if err := overflow.Send(ctx, p); err != nil {
+			fmt.Println("Send failed:", err)
+		}
+	}
+	overflow.Close()
+}
+
+func SendingWithOverflowPolicies() {
+	policies := []channels.OverflowPolicy{channels.Block, channels.DropNewest,
+		channels.DropOldest, channels.SpillToDisk}
+	for _, policy := range policies {
+		overflow, err := channels.NewOverflow[*Product](context.Background(), 3, policy, "")
+		if err != nil {
+			fmt.Println("Error:", err)
+			continue
+		}
+		go enumerateProductsWithOverflow(context.Background(), overflow)
+		time.Sleep(time.Millisecond * 100)
+		fmt.Println("Policy:", policy)
+		for p := range overflow.Out() {
+			fmt.Println("  Received product:", p.Name)
+		}
+		stats := overflow.Stats()
+		fmt.Println("  Sent:", stats.Sent, "Delivered:", stats.Delivered,
+			"Dropped:", stats.Dropped, "Spilled:", stats.Spilled)
+	}
+}
+
 func SendingUsingSelect() {
 	productChannel := make(chan *Product, 5)
 	go enumerateProductsForSending(productChannel)
@@ -212,6 +265,176 @@ func SendingOverMultipleChannel() {
 	}
 }
 
+// Taking orders from a file through a cancellable pipeline
+
+func ProcessingOrdersFromFile() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	dispatchChannel := make(chan DispatchNotification, 2)
+	errs := RunOrderPipeline(ctx, FileOrderSource("orders.jsonl"), dispatchChannel)
+	done := make(chan bool)
+	go func() {
+		for err := range errs {
+			fmt.Println("Rejected:", err)
+		}
+		done <- true
+	}()
+	receiveDispatches(dispatchChannel)
+	<-done
+}
+
+// Spreading dispatches over a pool of workers, keeping each customer's
+// orders in sequence
+
+func DispatchingWithWorkerPool() {
+	ctx := context.Background()
+	pool := NewWorkerPool(ctx, PoolOptions{Workers: 3, QueueCapacity: 5},
+		func(n DispatchNotification) string { return n.Customer },
+		func(ctx context.Context, n DispatchNotification) (float64, error) {
+			time.Sleep(time.Millisecond * 100)
+			if n.Quantity == 0 {
+				return 0, errors.New("nothing to dispatch")
+			}
+			return n.Price * float64(n.Quantity), nil
+		})
+	go func() {
+		dispatchChannel := make(chan DispatchNotification, 100)
+		go DispatchOrdersSelect(dispatchChannel)
+		for details := range dispatchChannel {
+			if err := pool.Submit(ctx, details); err != nil {
+				fmt.Println("Submit failed:", err)
+			}
+			fmt.Println("-- queue depth", pool.Metrics().QueueDepth)
+		}
+		pool.Close()
+	}()
+	for result := range pool.Results() {
+		if result.Err != nil {
+			fmt.Println("Worker", result.Worker, "failed", result.Item.Customer, ":", result.Err)
+		} else {
+			fmt.Println("Worker", result.Worker, "dispatched to", result.Item.Customer, ":",
+				result.Item.Quantity, "x", result.Item.Product.Name, ToCurrency(result.Value))
+		}
+	}
+	for _, worker := range pool.Metrics().Workers {
+		fmt.Println("Worker", worker.Worker, "processed", worker.Processed,
+			fmt.Sprintf("(%.1f/s)", worker.PerSecond), "failed", worker.Failed)
+	}
+}
+
+// The same receive-from-many and send-to-many jobs using the channels package,
+// without select loops, nil-ing closed channels or polling
+
+func UsingChannelUtilities() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+
+	first := make(chan DispatchNotification, 100)
+	second := make(chan DispatchNotification, 100)
+	go DispatchOrdersSelect(first)
+	go DispatchOrdersSelect(second)
+	merged := channels.Merge(ctx, first, second)
+	for batch := range channels.Batch(ctx, merged, 3, time.Second*2) {
+		fmt.Println("Batch of", len(batch), "dispatches")
+		for _, details := range batch {
+			fmt.Println("  Dispatch to", details.Customer, ":", details.Quantity,
+				"x", details.Product.Name)
+		}
+	}
+
+	productChannel := make(chan *Product)
+	go func() {
+		for _, p := range ProductList {
+			productChannel <- p
+		}
+		close(productChannel)
+	}()
+	throttled := channels.Throttle(ctx, productChannel, 4)
+	outs := channels.FanOut(ctx, throttled, 2, 2, channels.RoundRobin)
+	for p := range channels.Merge(ctx, outs...) {
+		fmt.Println("Product:", p.Name)
+	}
+	fmt.Println("All values received")
+}
+
+// Keeping dispatches in a file-backed queue so a crash doesn't lose them.
+// Anything left unacked is dispatched again on the next run.
+
+func DispatchingThroughDurableQueue() {
+	queue, err := OpenDispatchQueue(filepath.Join(os.TempDir(), "dispatches.wal"),
+		QueueOptions{VisibilityTimeout: time.Second * 5, MaxDeliveries: 3})
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	defer queue.Close()
+	go func() {
+		dispatchChannel := make(chan DispatchNotification, 100)
+		go DispatchOrders(dispatchChannel)
+		for details := range dispatchChannel {
+			if err := queue.Enqueue(details); err != nil {
+				fmt.Println("Enqueue failed:", err)
+			}
+		}
+		queue.Seal()
+	}()
+	deliveries, channelErr := queue.Channel(context.Background())
+	for delivery := range deliveries {
+		fmt.Println("Dispatch to", delivery.Customer, ":", delivery.Quantity,
+			"x", delivery.Product.Name)
+		if err := delivery.Ack(); err != nil {
+			fmt.Println("Ack failed:", err)
+		}
+	}
+	if err := channelErr(); err != nil {
+		fmt.Println("Error:", err)
+	}
+}
+
+// Reserving stock for orders from several dispatchers at once
+
+func DispatchingWithInventory() {
+	inventory := NewInventory(10)
+	for _, p := range ProductList {
+		inventory.SetStock(p, 10, 3)
+	}
+	go func() {
+		for alert := range inventory.Alerts() {
+			fmt.Println("-- Low stock:", alert.Product.Name, alert.Available, "left")
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dispatchChannel := make(chan DispatchNotification, 100)
+			go DispatchOrders(dispatchChannel)
+			for details := range dispatchChannel {
+				reservation, err := inventory.Reserve(details)
+				if err != nil {
+					fmt.Println("Rejected", details.Customer, ":", err)
+					continue
+				}
+				if err := inventory.Confirm(reservation.ID); err != nil {
+					fmt.Println("Holding", details.Customer, ":", details.Quantity,
+						"x", details.Product.Name, "-", err)
+					continue
+				}
+				fmt.Println("Dispatch to", details.Customer, ":", details.Quantity,
+					"x", details.Product.Name)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, p := range ProductList {
+		level, _ := inventory.Level(p)
+		fmt.Println(p.Name, "on hand:", level.OnHand, "reserved:", level.Reserved,
+			"backordered:", level.Backordered)
+	}
+}
+
 func main() {
 	fmt.Println("main function started")
 	// WhenNumberOfValuesAreKnown()
@@ -224,7 +447,13 @@ func main() {
 	// UsingSelectStatement()
 	// ReceivingFromMultipleChannel()
 	// SendingUsingSelect()
-	SendingOverMultipleChannel()
+	// SendingOverMultipleChannel()
+	// ProcessingOrdersFromFile()
+	// DispatchingWithWorkerPool()
+	// UsingChannelUtilities()
+	// SendingWithOverflowPolicies()
+	// DispatchingThroughDurableQueue()
+	DispatchingWithInventory()
 	// time.Sleep(time.Second * 5)
 	fmt.Println("main function ended")
 }
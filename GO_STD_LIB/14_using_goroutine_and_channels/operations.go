@@ -1,43 +1,115 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 )
 
-func CalcStoreTotal(data ProductData) {
-	var storeTotal float64
-	// var resultChannel chan float64 = make(chan float64)
-	var resultChannel chan float64 = make(chan float64, 2)
+// AggregateOptions limits how many categories are totalled at once and how
+// long the whole calculation may take. Zero means no limit.
 
-	for category, group := range data {
-		go group.TotalPrice(category, resultChannel)
+type AggregateOptions struct {
+	Concurrency int
+	Timeout     time.Duration
+}
+
+type CategoryTotal struct {
+	Category string
+	Products int
+	Total    float64
+	Err      error
+}
+
+// StoreTotal is the result of CalcStoreTotal. Total only includes the
+// categories that completed; Categories lists every one, sorted by name,
+// with Err set for those that failed or were cut short.
+
+type StoreTotal struct {
+	Total      float64
+	Categories []CategoryTotal
+}
+
+// CalcStoreTotal totals each category in its own goroutine, at most
+// options.Concurrency at a time. Like an errgroup it waits for every
+// goroutine it started, but rather than keeping only the first error it
+// returns them all, joined, alongside the categories that succeeded.
+
+func CalcStoreTotal(ctx context.Context, data ProductData, options AggregateOptions) (StoreTotal, error) {
+	if options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.Timeout)
+		defer cancel()
+	}
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = len(data)
 	}
+	semaphore := make(chan struct{}, concurrency)
+	results := make([]CategoryTotal, 0, len(data))
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
 
-	for i := 0; i < len(data); i++ {
-		fmt.Println("-- channel read pending", len(resultChannel), "items in buffer, size", cap(resultChannel))
-		value := <-resultChannel
-		fmt.Println("-- channel read complete", value)
-		storeTotal += value
-		time.Sleep(time.Second)
+	for category, group := range data {
+		result := CategoryTotal{Category: category, Products: len(group)}
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+			result.Err = fmt.Errorf("%v: %w", category, ctx.Err())
+			mutex.Lock()
+			results = append(results, result)
+			mutex.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func(group ProductGroup) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			result.Total, result.Err = group.TotalPrice(ctx, result.Category)
+			mutex.Lock()
+			results = append(results, result)
+			mutex.Unlock()
+		}(group)
 	}
+	wg.Wait()
 
-	fmt.Println("Total:", ToCurrency(storeTotal))
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Category < results[j].Category
+	})
+	var storeTotal StoreTotal
+	var errs []error
+	for _, result := range results {
+		if result.Err != nil {
+			errs = append(errs, result.Err)
+		} else {
+			storeTotal.Total += result.Total
+		}
+	}
+	storeTotal.Categories = results
+	return storeTotal, errors.Join(errs...)
 }
 
 // This file defines methods that operate on the type aliases created in the product.go file.
 // Methods can be defined only on types that are created in the same package, which means that I can’t define a method for the []*Product type,
 // for example, but I can create an alias for that type and use the alias as the method receiver.
 
-func (group ProductGroup) TotalPrice(category string, resultChannel chan<- float64) {
+// TotalPrice adds up the group, taking a little time per product to stand
+// in for real work, and gives up as soon as ctx is done.
+
+func (group ProductGroup) TotalPrice(ctx context.Context, category string) (float64, error) {
 	var total float64
+	work := time.NewTicker(time.Millisecond * 100)
+	defer work.Stop()
 	for _, p := range group {
-		fmt.Println(category, "product:", p.Name)
 		total += p.Price
-		time.Sleep(time.Millisecond * 100)
+		select {
+		case <-work.C:
+		case <-ctx.Done():
+			return 0, fmt.Errorf("%v: %w", category, ctx.Err())
+		}
 	}
-	fmt.Println(category, "channel sending", ToCurrency(total))
-	resultChannel <- total
-	fmt.Println(category, "channel send complete")
-	// This statement sends the total value through the resultChannel channel, which makes it available to be received elsewhere in the application.
+	return total, nil
 }
@@ -22,9 +22,9 @@ func DispatchOrders(channel chan DispatchNotification) {
 
 	for i := 0; i < orderCount; i++ {
 		channel <- DispatchNotification{
-			Customer: Customers[rand.Intn(len(Customers)-1)],
+			Customer: Customers[rand.Intn(len(Customers))],
 			Quantity: rand.Intn(10),
-			Product:  ProductList[rand.Intn(len(ProductList)-1)],
+			Product:  ProductList[rand.Intn(len(ProductList))],
 		}
 	}
 
@@ -37,9 +37,9 @@ func DispatchOrdersRestricted(channel chan<- DispatchNotification) {
 	fmt.Println("Order count:", orderCount)
 	for i := 0; i < orderCount; i++ {
 		channel <- DispatchNotification{
-			Customer: Customers[rand.Intn(len(Customers)-1)],
+			Customer: Customers[rand.Intn(len(Customers))],
 			Quantity: rand.Intn(10),
-			Product:  ProductList[rand.Intn(len(ProductList)-1)],
+			Product:  ProductList[rand.Intn(len(ProductList))],
 		}
 
 		// below code will start giving errors
@@ -58,9 +58,9 @@ func DispatchOrdersSelect(channel chan<- DispatchNotification) {
 	fmt.Println("Order count:", orderCount)
 	for i := 0; i < orderCount; i++ {
 		channel <- DispatchNotification{
-			Customer: Customers[rand.Intn(len(Customers)-1)],
+			Customer: Customers[rand.Intn(len(Customers))],
 			Quantity: rand.Intn(10),
-			Product:  ProductList[rand.Intn(len(ProductList)-1)],
+			Product:  ProductList[rand.Intn(len(ProductList))],
 		}
 		// if (i == 1) {
 		//     notification := <- channel
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An Order is what arrives from outside: the product is named rather than
+// pointed to, and nothing about it has been checked yet.
+
+type Order struct {
+	Customer string
+	Product  string
+	Quantity int
+}
+
+var (
+	ErrUnknownProduct  = errors.New("unknown product")
+	ErrInvalidQuantity = errors.New("quantity must be positive")
+	ErrMissingCustomer = errors.New("customer is required")
+)
+
+// OrderError reports an order that was rejected by one of the stages.
+
+type OrderError struct {
+	Order Order
+	Err   error
+}
+
+func (e *OrderError) Error() string {
+	return fmt.Sprintf("order %v x %q for %q: %v", e.Order.Quantity, e.Order.Product,
+		e.Order.Customer, e.Err)
+}
+
+func (e *OrderError) Unwrap() error {
+	return e.Err
+}
+
+// Each stage reads from the previous one and closes its own output only
+// once its input is closed. When ctx is cancelled the source stops and the
+// later stages discard whatever is still in flight, so the pipeline drains
+// from the front and no stage is left blocked. Problems are reported on
+// errs, which the caller must keep reading until RunOrderPipeline closes it.
+
+type OrderSource func(ctx context.Context, errs chan<- error) <-chan Order
+
+func reportError(ctx context.Context, errs chan<- error, err error) {
+	select {
+	case errs <- err:
+	case <-ctx.Done():
+	}
+}
+
+// FileOrderSource reads one JSON order per line. Lines that do not parse
+// are reported and skipped.
+
+func FileOrderSource(path string) OrderSource {
+	return func(ctx context.Context, errs chan<- error) <-chan Order {
+		out := make(chan Order)
+		go func() {
+			defer close(out)
+			file, err := os.Open(path)
+			if err != nil {
+				reportError(ctx, errs, err)
+				return
+			}
+			defer file.Close()
+			scanner := bufio.NewScanner(file)
+			for line := 1; scanner.Scan(); line++ {
+				text := strings.TrimSpace(scanner.Text())
+				if text == "" {
+					continue
+				}
+				var order Order
+				if err := json.Unmarshal([]byte(text), &order); err != nil {
+					reportError(ctx, errs, fmt.Errorf("%v line %v: %w", path, line, err))
+					continue
+				}
+				select {
+				case out <- order:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err := scanner.Err(); err != nil {
+				reportError(ctx, errs, err)
+			}
+		}()
+		return out
+	}
+}
+
+// HTTPOrderSource accepts POSTed orders (a single JSON object or an array)
+// on addr until ctx is cancelled. A request does not complete until the
+// pipeline has taken every order in it, so a busy pipeline slows clients
+// down instead of queueing without limit. The output is closed only once
+// the server has shut down and no handler can send on it any more.
+
+func HTTPOrderSource(addr string) OrderSource {
+	return func(ctx context.Context, errs chan<- error) <-chan Order {
+		out := make(chan Order)
+		handler := orderHandler(ctx, out)
+		var (
+			mutex    sync.Mutex
+			closed   bool
+			requests sync.WaitGroup
+		)
+		server := &http.Server{Addr: addr, Handler: http.HandlerFunc(
+			func(writer http.ResponseWriter, request *http.Request) {
+				mutex.Lock()
+				if closed {
+					mutex.Unlock()
+					http.Error(writer, "Shutting down", http.StatusServiceUnavailable)
+					return
+				}
+				requests.Add(1)
+				mutex.Unlock()
+				defer requests.Done()
+				handler.ServeHTTP(writer, request)
+			})}
+		go func() {
+			defer close(out)
+			served := make(chan error, 1)
+			go func() {
+				served <- server.ListenAndServe()
+			}()
+			select {
+			case err := <-served:
+				reportError(ctx, errs, err)
+			case <-ctx.Done():
+			}
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				server.Close()
+			}
+			mutex.Lock()
+			closed = true
+			mutex.Unlock()
+			requests.Wait()
+		}()
+		return out
+	}
+}
+
+func orderHandler(ctx context.Context, out chan<- Order) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost {
+			writer.Header().Set("Allow", http.MethodPost)
+			http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var orders []Order
+		body := json.NewDecoder(http.MaxBytesReader(writer, request.Body, 1<<20))
+		var raw json.RawMessage
+		if err := body.Decode(&raw); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if strings.HasPrefix(strings.TrimSpace(string(raw)), "[") {
+			if err := json.Unmarshal(raw, &orders); err != nil {
+				http.Error(writer, err.Error(), http.StatusBadRequest)
+				return
+			}
+		} else {
+			var order Order
+			if err := json.Unmarshal(raw, &order); err != nil {
+				http.Error(writer, err.Error(), http.StatusBadRequest)
+				return
+			}
+			orders = append(orders, order)
+		}
+		for i, order := range orders {
+			select {
+			case out <- order:
+			case <-ctx.Done():
+				http.Error(writer, fmt.Sprintf("Accepted %v of %v orders", i, len(orders)),
+					http.StatusServiceUnavailable)
+				return
+			case <-request.Context().Done():
+				return
+			}
+		}
+		writer.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(writer, "Accepted %v orders\n", len(orders))
+	})
+}
+
+// findProduct matches names case-insensitively against ProductList.
+
+func findProduct(name string) (*Product, bool) {
+	for _, p := range ProductList {
+		if strings.EqualFold(p.Name, strings.TrimSpace(name)) {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+func validateOrder(order Order) error {
+	switch {
+	case strings.TrimSpace(order.Customer) == "":
+		return ErrMissingCustomer
+	case order.Quantity <= 0:
+		return ErrInvalidQuantity
+	}
+	if _, ok := findProduct(order.Product); !ok {
+		return ErrUnknownProduct
+	}
+	return nil
+}
+
+// ValidateOrders passes on the orders that name a known product, a
+// customer and a positive quantity, and reports the rest as OrderErrors.
+
+func ValidateOrders(ctx context.Context, in <-chan Order, errs chan<- error) <-chan Order {
+	out := make(chan Order)
+	go func() {
+		defer close(out)
+		for order := range in {
+			if err := validateOrder(order); err != nil {
+				reportError(ctx, errs, &OrderError{Order: order, Err: err})
+				continue
+			}
+			select {
+			case out <- order:
+			case <-ctx.Done():
+				// Keep reading so the earlier stages can finish.
+			}
+		}
+	}()
+	return out
+}
+
+// EnrichOrders turns validated orders into DispatchNotifications, tidying
+// the customer name and resolving the product from ProductList.
+
+func EnrichOrders(ctx context.Context, in <-chan Order, errs chan<- error) <-chan DispatchNotification {
+	out := make(chan DispatchNotification)
+	go func() {
+		defer close(out)
+		for order := range in {
+			product, ok := findProduct(order.Product)
+			if !ok {
+				reportError(ctx, errs, &OrderError{Order: order, Err: ErrUnknownProduct})
+				continue
+			}
+			notification := DispatchNotification{
+				Customer: strings.TrimSpace(order.Customer),
+				Product:  product,
+				Quantity: order.Quantity,
+			}
+			select {
+			case out <- notification:
+			case <-ctx.Done():
+				// Keep reading so the earlier stages can finish.
+			}
+		}
+	}()
+	return out
+}
+
+// DispatchOrdersTo forwards notifications to the consumer's channel. The
+// send blocks while the channel is full, which is what pushes back on the
+// earlier stages and, through them, on the source. dispatch is closed once
+// the input runs out.
+
+func DispatchOrdersTo(ctx context.Context, in <-chan DispatchNotification, dispatch chan<- DispatchNotification) {
+	defer close(dispatch)
+	for notification := range in {
+		select {
+		case dispatch <- notification:
+		case <-ctx.Done():
+			// Keep reading so the earlier stages can finish.
+		}
+	}
+}
+
+// RunOrderPipeline connects source → validate → enrich → dispatch and
+// returns the channel on which rejected orders and source failures are
+// reported. It is closed once every stage has finished.
+
+func RunOrderPipeline(ctx context.Context, source OrderSource, dispatch chan<- DispatchNotification) <-chan error {
+	errs := make(chan error, 10)
+	orders := source(ctx, errs)
+	valid := ValidateOrders(ctx, orders, errs)
+	notifications := EnrichOrders(ctx, valid, errs)
+	go func() {
+		// notifications is only closed after every earlier stage is done.
+		DispatchOrdersTo(ctx, notifications, dispatch)
+		close(errs)
+	}()
+	return errs
+}
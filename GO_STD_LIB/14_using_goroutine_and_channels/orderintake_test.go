@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func postOrders(addr, body string) (int, error) {
+	response, err := http.Post("http://"+addr, "application/json", strings.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+	return response.StatusCode, nil
+}
+
+func TestHTTPOrderSourceAcceptsOrders(t *testing.T) {
+	addr := freeAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 1)
+	out := HTTPOrderSource(addr)(ctx, errs)
+
+	var status int
+	var err error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			if status, err = postOrders(addr, `[{"Customer":"Alice","Product":"Kayak","Quantity":1},
+				{"Customer":"Bob","Product":"Lifejacket","Quantity":2}]`); err == nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	var orders []Order
+	for len(orders) < 2 {
+		orders = append(orders, <-out)
+	}
+	<-done
+	if err != nil || status != http.StatusAccepted {
+		t.Fatalf("POST: %v %v", status, err)
+	}
+	if orders[0].Customer != "Alice" || orders[1].Quantity != 2 {
+		t.Errorf("orders %+v", orders)
+	}
+	cancel()
+	for range out {
+	}
+}
+
+// TestHTTPOrderSourceShutdown cancels the source while clients are still
+// posting. Run with -race: the output must not be closed while a handler
+// can still send on it.
+
+func TestHTTPOrderSourceShutdown(t *testing.T) {
+	addr := freeAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	out := HTTPOrderSource(addr)(ctx, errs)
+
+	body := "[" + strings.Repeat(`{"Customer":"Alice","Product":"Kayak","Quantity":1},`, 20) +
+		`{"Customer":"Alice","Product":"Kayak","Quantity":1}]`
+	var clients sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			for ctx.Err() == nil {
+				postOrders(addr, body)
+			}
+		}()
+	}
+	for received := 0; received < 100; received++ {
+		<-out
+	}
+	cancel()
+	closed := make(chan struct{})
+	go func() {
+		for range out {
+		}
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("output not closed after shutdown")
+	}
+	clients.Wait()
+}
+
+func TestHTTPOrderSourceListenError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	errs := make(chan error, 1)
+	out := HTTPOrderSource(listener.Addr().String())(context.Background(), errs)
+	select {
+	case _, ok := <-out:
+		if ok {
+			t.Fatal("got an order")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("output not closed after listen error")
+	}
+	if err := <-errs; err == nil {
+		t.Error("listen error not reported")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrPoolClosed = errors.New("worker pool is closed")
+
+// PoolOptions sizes a WorkerPool. Each worker has its own queue holding up
+// to QueueCapacity items, and Submit blocks while the target queue is full.
+
+type PoolOptions struct {
+	Workers       int
+	QueueCapacity int
+}
+
+type PoolResult[T, R any] struct {
+	Item   T
+	Value  R
+	Err    error
+	Worker int
+}
+
+// WorkerMetrics reports one worker's queue and counts. PerSecond is the
+// number of items it processed per second since the pool started, up to
+// when the pool finished or now if it is still running.
+
+type WorkerMetrics struct {
+	Worker     int
+	QueueDepth int
+	Processed  uint64
+	Failed     uint64
+	PerSecond  float64
+}
+
+type PoolMetrics struct {
+	QueueDepth int
+	Workers    []WorkerMetrics
+}
+
+// WorkerPool fans items out to a fixed set of workers. Items with the same
+// key always go to the same worker, so they are handled in the order they
+// were submitted; items with different keys run in parallel.
+
+type WorkerPool[T, R any] struct {
+	ctx       context.Context
+	key       func(T) string
+	handle    func(context.Context, T) (R, error)
+	queues    []chan T
+	results   chan PoolResult[T, R]
+	processed []atomic.Uint64
+	failed    []atomic.Uint64
+	mutex     sync.RWMutex
+	closed    bool
+	workers   sync.WaitGroup
+	stopWatch func() bool
+	started   time.Time
+	finished  atomic.Int64
+}
+
+// NewWorkerPool starts the workers. When ctx is cancelled the pool stops
+// taking items, but whatever is already queued is still handed to handle
+// (which sees the cancelled ctx) so that every submitted item produces a
+// result. Results must be read until the channel is closed.
+
+func NewWorkerPool[T, R any](ctx context.Context, options PoolOptions, key func(T) string,
+	handle func(context.Context, T) (R, error)) *WorkerPool[T, R] {
+	if options.Workers < 1 {
+		options.Workers = 1
+	}
+	if options.QueueCapacity < 0 {
+		options.QueueCapacity = 0
+	}
+	pool := &WorkerPool[T, R]{
+		ctx:       ctx,
+		key:       key,
+		handle:    handle,
+		queues:    make([]chan T, options.Workers),
+		results:   make(chan PoolResult[T, R], options.Workers),
+		processed: make([]atomic.Uint64, options.Workers),
+		failed:    make([]atomic.Uint64, options.Workers),
+		started:   time.Now(),
+	}
+	for i := range pool.queues {
+		pool.queues[i] = make(chan T, options.QueueCapacity)
+		pool.workers.Add(1)
+		go pool.work(i)
+	}
+	go func() {
+		pool.workers.Wait()
+		pool.finished.Store(time.Now().UnixNano())
+		close(pool.results)
+	}()
+	pool.stopWatch = context.AfterFunc(ctx, pool.Close)
+	return pool
+}
+
+func (pool *WorkerPool[T, R]) work(worker int) {
+	defer pool.workers.Done()
+	for item := range pool.queues[worker] {
+		value, err := pool.handle(pool.ctx, item)
+		if err != nil {
+			pool.failed[worker].Add(1)
+		}
+		pool.processed[worker].Add(1)
+		pool.results <- PoolResult[T, R]{Item: item, Value: value, Err: err, Worker: worker}
+	}
+}
+
+func (pool *WorkerPool[T, R]) workerFor(item T) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(pool.key(item)))
+	return int(hash.Sum32() % uint32(len(pool.queues)))
+}
+
+// Submit queues an item, waiting while its worker's queue is full. It
+// fails if the pool has been closed or either context is cancelled first.
+
+func (pool *WorkerPool[T, R]) Submit(ctx context.Context, item T) error {
+	pool.mutex.RLock()
+	defer pool.mutex.RUnlock()
+	if pool.closed {
+		return ErrPoolClosed
+	}
+	select {
+	case pool.queues[pool.workerFor(item)] <- item:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-pool.ctx.Done():
+		return ErrPoolClosed
+	}
+}
+
+func (pool *WorkerPool[T, R]) Results() <-chan PoolResult[T, R] {
+	return pool.results
+}
+
+// Close stops new submissions. Queued items are still processed, and the
+// results channel is closed after the last of them.
+
+func (pool *WorkerPool[T, R]) Close() {
+	pool.stopWatch()
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.closed {
+		return
+	}
+	pool.closed = true
+	for _, queue := range pool.queues {
+		close(queue)
+	}
+}
+
+func (pool *WorkerPool[T, R]) Metrics() PoolMetrics {
+	end := time.Now()
+	if finished := pool.finished.Load(); finished != 0 {
+		end = time.Unix(0, finished)
+	}
+	elapsed := end.Sub(pool.started).Seconds()
+	var metrics PoolMetrics
+	for i, queue := range pool.queues {
+		worker := WorkerMetrics{
+			Worker:     i,
+			QueueDepth: len(queue),
+			Processed:  pool.processed[i].Load(),
+			Failed:     pool.failed[i].Load(),
+		}
+		if elapsed > 0 {
+			worker.PerSecond = float64(worker.Processed) / elapsed
+		}
+		metrics.QueueDepth += worker.QueueDepth
+		metrics.Workers = append(metrics.Workers, worker)
+	}
+	return metrics
+}
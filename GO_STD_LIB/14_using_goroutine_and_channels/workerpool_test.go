@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type poolItem struct {
+	Key string
+	Seq int
+}
+
+func poolKey(item poolItem) string { return item.Key }
+
+// drain reads results until the channel is closed, failing the test if
+// that takes more than a few seconds.
+
+func drain[T, R any](t *testing.T, pool *WorkerPool[T, R]) []PoolResult[T, R] {
+	t.Helper()
+	var results []PoolResult[T, R]
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case result, ok := <-pool.Results():
+			if !ok {
+				return results
+			}
+			results = append(results, result)
+		case <-timeout:
+			t.Fatalf("results not closed after %d", len(results))
+		}
+	}
+}
+
+func TestWorkerPoolKeepsKeyOrder(t *testing.T) {
+	pool := NewWorkerPool(context.Background(), PoolOptions{Workers: 4, QueueCapacity: 2}, poolKey,
+		func(ctx context.Context, item poolItem) (int, error) {
+			// Later items finish faster, so only the queue keeps them in order.
+			time.Sleep(time.Duration(20-item.Seq) * 100 * time.Microsecond)
+			return item.Seq, nil
+		})
+	go func() {
+		for seq := 0; seq < 20; seq++ {
+			for key := 0; key < 6; key++ {
+				pool.Submit(context.Background(), poolItem{"customer " + strconv.Itoa(key), seq})
+			}
+		}
+		pool.Close()
+	}()
+
+	next, workers := map[string]int{}, map[string]int{}
+	results := drain(t, pool)
+	for _, result := range results {
+		key := result.Item.Key
+		if result.Value != next[key] {
+			t.Fatalf("%v: got item %d, want %d", key, result.Value, next[key])
+		}
+		next[key]++
+		if worker, seen := workers[key]; seen && worker != result.Worker {
+			t.Errorf("%v handled by workers %d and %d", key, worker, result.Worker)
+		}
+		workers[key] = result.Worker
+	}
+	if len(results) != 120 {
+		t.Errorf("%d results, want 120", len(results))
+	}
+}
+
+func TestWorkerPoolCloseDrainsQueue(t *testing.T) {
+	release := make(chan struct{})
+	pool := NewWorkerPool(context.Background(), PoolOptions{Workers: 2, QueueCapacity: 10}, poolKey,
+		func(ctx context.Context, item poolItem) (int, error) {
+			<-release
+			if item.Seq%3 == 0 {
+				return 0, errors.New("failed")
+			}
+			return item.Seq, nil
+		})
+	for seq := 0; seq < 12; seq++ {
+		if err := pool.Submit(context.Background(), poolItem{strconv.Itoa(seq % 4), seq}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pool.Close()
+	pool.Close()
+	if err := pool.Submit(context.Background(), poolItem{"0", 12}); !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("Submit after Close: %v", err)
+	}
+	if depth := pool.Metrics().QueueDepth; depth == 0 {
+		t.Error("queue empty before the workers were released")
+	}
+	close(release)
+
+	if results := drain(t, pool); len(results) != 12 {
+		t.Errorf("%d results after Close, want all 12", len(results))
+	}
+	var processed, failed uint64
+	for _, worker := range pool.Metrics().Workers {
+		processed += worker.Processed
+		failed += worker.Failed
+		if worker.Processed > 0 && worker.PerSecond <= 0 {
+			t.Errorf("worker %d: rate %v for %d items", worker.Worker, worker.PerSecond, worker.Processed)
+		}
+	}
+	if processed != 12 || failed != 4 {
+		t.Errorf("metrics: %d processed, %d failed; want 12 and 4", processed, failed)
+	}
+	rate := pool.Metrics().Workers[0].PerSecond
+	time.Sleep(20 * time.Millisecond)
+	if later := pool.Metrics().Workers[0].PerSecond; later != rate {
+		t.Errorf("rate kept changing after the pool finished: %v then %v", rate, later)
+	}
+}
+
+func TestWorkerPoolCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	pool := NewWorkerPool(ctx, PoolOptions{Workers: 1, QueueCapacity: 1}, poolKey,
+		func(ctx context.Context, item poolItem) (int, error) {
+			if item.Seq == 0 {
+				close(started)
+				<-ctx.Done()
+			}
+			return item.Seq, ctx.Err()
+		})
+	pool.Submit(context.Background(), poolItem{"a", 0})
+	<-started
+	pool.Submit(context.Background(), poolItem{"a", 1})
+
+	blocked := make(chan error)
+	go func() { blocked <- pool.Submit(context.Background(), poolItem{"a", 2}) }()
+	cancel()
+	if err := <-blocked; !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("blocked Submit returned %v, want ErrPoolClosed", err)
+	}
+
+	results := drain(t, pool)
+	if len(results) != 2 {
+		t.Fatalf("%d results, want the 2 accepted items", len(results))
+	}
+	for _, result := range results {
+		if !errors.Is(result.Err, context.Canceled) {
+			t.Errorf("item %d: handler saw %v", result.Item.Seq, result.Err)
+		}
+	}
+}
+
+// TestWorkerPoolCloseStopsWatcher checks that pools closed before their
+// context ends don't leave a goroutine waiting on it.
+
+func TestWorkerPoolCloseStopsWatcher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		pool := NewWorkerPool(ctx, PoolOptions{Workers: 2}, poolKey,
+			func(ctx context.Context, item poolItem) (int, error) { return 0, nil })
+		pool.Close()
+		drain(t, pool)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines before, %d after closing 50 pools", before, after)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors for the product domain. Compare against them with
+// errors.Is, since they usually arrive wrapped.
+
+var (
+	ErrCategoryNotFound = errors.New("category not found")
+	ErrEmptyCategory    = errors.New("category name is empty")
+	ErrInvalidPrice     = errors.New("invalid price")
+)
+
+// CategoryNotFoundError says which category was missing. It matches
+// ErrCategoryNotFound with errors.Is, and errors.As recovers the category.
+
+type CategoryNotFoundError struct {
+	Category string
+}
+
+func (e *CategoryNotFoundError) Error() string {
+	return "Category " + e.Category + " does not exist"
+}
+
+func (e *CategoryNotFoundError) Is(target error) bool {
+	return target == ErrCategoryNotFound
+}
+
+// ProductError ties a problem with a single product to its name.
+
+type ProductError struct {
+	Product string
+	Err     error
+}
+
+func (e *ProductError) Error() string {
+	return fmt.Sprintf("product %v: %v", e.Product, e.Err)
+}
+
+func (e *ProductError) Unwrap() error {
+	return e.Err
+}
@@ -1,15 +1,25 @@
 package main
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"errorHandling/supervisor"
+)
 
 func HandlingAnError() {
 	categories := []string{"Watersports", "Chess", "Running"}
 	for _, cat := range categories {
 		total, err := Products.TotalPrice(cat)
+		var notFound *CategoryNotFoundError
 		if err == nil {
 			fmt.Println(cat, "Total:", ToCurrency(total))
+		} else if errors.As(err, &notFound) {
+			fmt.Println(notFound.Category, "(no such category)")
 		} else {
-			fmt.Println(cat, "(no such category)")
+			fmt.Println(cat, "Error:", err)
 		}
 	}
 }
@@ -17,7 +27,7 @@ func HandlingAnError() {
 func UsingAsyncMethod() {
 	categories := []string{"Watersports", "Chess", "Running"}
 	channel := make(chan ChannelMessage, 10)
-	go Products.TotalPriceAsync(categories, channel)
+	go Products.TotalPriceAsync(context.Background(), categories, channel, AsyncOptions{Ordered: true})
 	for message := range channel {
 		if message.CategoryError == nil {
 			fmt.Println(message.Category, "Total:", ToCurrency(message.Total))
@@ -31,7 +41,7 @@ func TriggeringPanic() {
 	categories := []string{"Watersports", "Chess", "Running"}
 	channel := make(chan ChannelMessage, 10)
 	// defer fmt.Println("Hello World")
-	go Products.TotalPriceAsync(categories, channel)
+	go Products.TotalPriceAsync(context.Background(), categories, channel, AsyncOptions{Ordered: true})
 	for message := range channel {
 		if message.CategoryError == nil {
 			fmt.Println(message.Category, "Total:", ToCurrency(message.Total))
@@ -58,7 +68,7 @@ func RecoveringFromPanic() {
 	defer recoveryFunc()
 	categories := []string{"Watersports", "Chess", "Running"}
 	channel := make(chan ChannelMessage, 10)
-	go Products.TotalPriceAsync(categories, channel)
+	go Products.TotalPriceAsync(context.Background(), categories, channel, AsyncOptions{Ordered: true})
 	for message := range channel {
 		if message.CategoryError == nil {
 			fmt.Println(message.Category, "Total:", ToCurrency(message.Total))
@@ -75,6 +85,9 @@ type CategoryCountMessage struct {
 }
 
 func processCategories(categories []string, outChan chan<- CategoryCountMessage) {
+	// Deferred first so it runs last, after the recovery, whether or not
+	// there was a panic. Otherwise the reader waits for ever.
+	defer close(outChan)
 	defer func() {
 		if arg := recover(); arg != nil {
 			fmt.Println("RECOVERING IN GOROUTINE")
@@ -82,7 +95,7 @@ func processCategories(categories []string, outChan chan<- CategoryCountMessage)
 		}
 	}()
 	channel := make(chan ChannelMessage, 10)
-	go Products.TotalPriceAsync(categories, channel)
+	go Products.TotalPriceAsync(context.Background(), categories, channel, AsyncOptions{Ordered: true})
 	for message := range channel {
 		if message.CategoryError == nil {
 			outChan <- CategoryCountMessage{
@@ -93,7 +106,6 @@ func processCategories(categories []string, outChan chan<- CategoryCountMessage)
 			panic(message.CategoryError)
 		}
 	}
-	close(outChan)
 }
 
 func RecoveringFromPanicInGoroutine() {
@@ -105,10 +117,100 @@ func RecoveringFromPanicInGoroutine() {
 	}
 }
 
+// Collecting every category error from one call
+
+func InspectingJoinedErrors() {
+	categories := []string{"Watersports", "Chess", "Running", "", "Cycling"}
+	channel := make(chan ChannelMessage, len(categories))
+	err := Products.TotalPriceAsync(context.Background(), categories, channel, AsyncOptions{})
+	for message := range channel {
+		if message.CategoryError == nil {
+			fmt.Println(message.Category, "Total:", ToCurrency(message.Total))
+		}
+	}
+	if errors.Is(err, ErrCategoryNotFound) {
+		fmt.Println("Some categories were not found")
+	}
+	if errors.Is(err, ErrEmptyCategory) {
+		fmt.Println("A category name was empty")
+	}
+	var notFound *CategoryNotFoundError
+	if errors.As(err, &notFound) {
+		fmt.Println("First missing category:", notFound.Category)
+	}
+	fmt.Println("All errors:")
+	fmt.Println(err)
+}
+
+// Letting a supervisor recover panics, restart the work and close the
+// output channel
+
+func SupervisingGoroutines() {
+	sup := supervisor.New(supervisor.Options{
+		Restart:     supervisor.OnFailure,
+		MaxRestarts: 2,
+		Backoff:     time.Millisecond * 100,
+	})
+	categories := []string{"Watersports", "Chess", "Running"}
+	channel := make(chan CategoryCountMessage)
+	supervisor.Produce(sup, context.Background(), channel,
+		func(ctx context.Context, out chan<- CategoryCountMessage) error {
+			messages := make(chan ChannelMessage, len(categories))
+			go Products.TotalPriceAsync(ctx, categories, messages, AsyncOptions{Ordered: true})
+			for message := range messages {
+				if message.CategoryError != nil {
+					panic(message.CategoryError)
+				}
+				select {
+				case out <- CategoryCountMessage{Category: message.Category, Count: int(message.Total)}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return nil
+		})
+	for message := range channel {
+		fmt.Println(message.Category, "Total:", message.Count)
+	}
+	err := sup.Wait()
+	var panicErr *supervisor.PanicError
+	if errors.As(err, &panicErr) {
+		fmt.Println("Recovered panic:", panicErr.Value)
+	}
+	if errors.Is(err, ErrCategoryNotFound) {
+		fmt.Println("Cause: a category was not found")
+	}
+}
+
+// Stopping at the first missing category, with results in completion order
+
+func StoppingAsyncTotalsEarly() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	categories := []string{"Watersports", "Chess", "Running", "Soccer", "Cycling"}
+	channel := make(chan ChannelMessage)
+	result := make(chan error)
+	go func() {
+		result <- Products.TotalPriceAsync(ctx, categories, channel,
+			AsyncOptions{Stop: StopOnError})
+	}()
+	for message := range channel {
+		if message.CategoryError == nil {
+			fmt.Println(message.Category, "Total:", ToCurrency(message.Total))
+		} else {
+			fmt.Println(message.Category, "Error:", message.CategoryError)
+		}
+	}
+	fmt.Println("Stopped with:", <-result)
+}
+
 func main() {
 	// HandlingAnError()
 	// UsingAsyncMethod()
 	// TriggeringPanic()
 	// RecoveringFromPanic()
-	RecoveringFromPanicInGoroutine()
+	// RecoveringFromPanicInGoroutine()
+	// InspectingJoinedErrors()
+	// SupervisingGoroutines()
+	StoppingAsyncTotalsEarly()
 }
@@ -1,6 +1,12 @@
 package main
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
 
 // type CategoryError struct {
 // 	requestedCategory string
@@ -33,31 +39,146 @@ type ChannelMessage struct {
 // }
 
 // Using the Errors Convenience Function
+// func (slice ProductSlice) TotalPrice(category string) (total float64, err error) {
+// 	productCount := 0
+// 	for _, p := range slice {
+// 		if p.Category == category {
+// 			total += p.Price
+// 			productCount++
+// 		}
+// 	}
+
+// 	if productCount == 0 {
+// 		err = errors.New("Cannot find Category")
+// 	}
+// 	return
+// }
+
+// Using the error types and sentinels from errors.go
+
+// TotalPrice returns a *CategoryNotFoundError when no product is in the
+// category, and wraps ErrEmptyCategory or ErrInvalidPrice for bad input.
+
 func (slice ProductSlice) TotalPrice(category string) (total float64, err error) {
+	if category == "" {
+		return 0, fmt.Errorf("total price: %w", ErrEmptyCategory)
+	}
 	productCount := 0
 	for _, p := range slice {
 		if p.Category == category {
+			if p.Price < 0 {
+				return 0, fmt.Errorf("total price of %v: %w", category,
+					&ProductError{Product: p.Name, Err: ErrInvalidPrice})
+			}
 			total += p.Price
 			productCount++
 		}
 	}
 
 	if productCount == 0 {
-		err = errors.New("Cannot find Category")
+		err = &CategoryNotFoundError{Category: category}
 	}
 	return
 }
 
-func (slice ProductSlice) TotalPriceAsync(categories []string, channel chan ChannelMessage) {
-	for _, c := range categories {
-		total, err := slice.TotalPrice(c)
+// StopPolicy decides when TotalPriceAsync gives up early. Cancelling ctx
+// always stops it; StopOnError also stops at the first category error.
 
-		channel <- ChannelMessage{
-			Category:      c,
-			Total:         total,
-			CategoryError: err,
+type StopPolicy int
+
+const (
+	StopOnCancel StopPolicy = iota
+	StopOnError
+)
+
+// AsyncOptions for TotalPriceAsync. Ordered sends messages in the order of
+// the categories argument; otherwise each is sent as soon as it is ready.
+
+type AsyncOptions struct {
+	Ordered bool
+	Stop    StopPolicy
+}
+
+type asyncResult struct {
+	message ChannelMessage
+	skipped bool
+}
+
+// TotalPriceAsync totals the categories concurrently, sends one message
+// per category and closes the channel when it returns. If it stops early,
+// categories not yet sent are left out. It returns the errors of the
+// messages it sent, the error that made it stop and ctx's error if it was
+// cancelled, joined together so errors.Is and errors.As can search them.
+
+func (slice ProductSlice) TotalPriceAsync(ctx context.Context, categories []string,
+	channel chan<- ChannelMessage, options AsyncOptions) error {
+	defer close(channel)
+	workCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var stopOnce sync.Once
+	var stopErr error
+
+	// Every goroutine writes exactly one result into a buffered channel,
+	// so none of them is left blocked if we stop reading early.
+	slots := make([]chan asyncResult, len(categories))
+	completed := make(chan asyncResult, len(categories))
+	for i, c := range categories {
+		slots[i] = make(chan asyncResult, 1)
+		go func(slot chan<- asyncResult, category string) {
+			result := asyncResult{skipped: workCtx.Err() != nil}
+			if !result.skipped {
+				total, err := slice.TotalPrice(category)
+				result.message = ChannelMessage{Category: category, Total: total, CategoryError: err}
+				if err != nil && options.Stop == StopOnError {
+					stopOnce.Do(func() {
+						stopErr = err
+						cancel()
+					})
+				}
+			}
+			slot <- result
+		}(slots[i], c)
+	}
+	if !options.Ordered {
+		for i := range slots {
+			go func(slot <-chan asyncResult) {
+				completed <- <-slot
+			}(slots[i])
 		}
 	}
 
-	close(channel)
+	var errs []error
+	for i := range categories {
+		var result asyncResult
+		if options.Ordered {
+			result = <-slots[i]
+		} else {
+			result = <-completed
+		}
+		if result.skipped {
+			if options.Ordered {
+				break
+			}
+			// The message that caused the stop may still be on its way.
+			continue
+		}
+		select {
+		case channel <- result.message:
+		case <-ctx.Done():
+			return errors.Join(append(errs, ctx.Err())...)
+		}
+		if err := result.message.CategoryError; err != nil {
+			errs = append(errs, err)
+			if options.Stop == StopOnError {
+				break
+			}
+		}
+	}
+	// Going through stopOnce makes a worker's write to stopErr visible
+	// here, and stops any later worker from writing it.
+	stopOnce.Do(func() {})
+	if stopErr != nil && !slices.Contains(errs, stopErr) {
+		errs = append(errs, stopErr)
+	}
+	return errors.Join(append(errs, ctx.Err())...)
 }
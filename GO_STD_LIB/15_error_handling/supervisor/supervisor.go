@@ -0,0 +1,185 @@
+// Package supervisor runs goroutines that may fail or panic, restarting
+// them according to a policy and collecting what went wrong so it can be
+// returned from Wait instead of being printed and forgotten.
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+type RestartPolicy int
+
+const (
+	// Never runs the function once.
+	Never RestartPolicy = iota
+	// OnFailure runs it again after it returns an error or panics.
+	OnFailure
+	// Always runs it again whenever it returns, until ctx is cancelled.
+	Always
+)
+
+// Options controls restarts. The delay before a restart starts at Backoff
+// and doubles each time up to MaxBackoff; it resets after a successful
+// run. MaxRestarts of zero means no limit. KeepErrors is how many of the
+// most recent errors Wait returns, 10 if it is zero; older ones are only
+// counted, so a function restarted forever doesn't use up memory.
+
+type Options struct {
+	Restart     RestartPolicy
+	MaxRestarts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	KeepErrors  int
+}
+
+// PanicError is what a recovered panic becomes. If the panic value was an
+// error, errors.Is and errors.As see through to it. The message leaves
+// out the stack, which Stack returns.
+
+type PanicError struct {
+	Value interface{}
+	stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// Stack is the stack trace of the goroutine that panicked.
+
+func (e *PanicError) Stack() []byte {
+	return e.stack
+}
+
+func (e *PanicError) Unwrap() error {
+	if err, ok := e.Value.(error); ok {
+		return err
+	}
+	return nil
+}
+
+type Supervisor struct {
+	options  Options
+	wg       sync.WaitGroup
+	mutex    sync.Mutex
+	errs     []error
+	failures int
+}
+
+func New(options Options) *Supervisor {
+	if options.Backoff <= 0 {
+		options.Backoff = 100 * time.Millisecond
+	}
+	if options.MaxBackoff < options.Backoff {
+		options.MaxBackoff = 30 * time.Second
+	}
+	if options.KeepErrors <= 0 {
+		options.KeepErrors = 10
+	}
+	return &Supervisor{options: options}
+}
+
+// call runs fn, turning a panic into a *PanicError.
+
+func call(ctx context.Context, fn func(context.Context) error) (err error) {
+	defer func() {
+		if arg := recover(); arg != nil {
+			err = &PanicError{Value: arg, stack: debug.Stack()}
+		}
+	}()
+	return fn(ctx)
+}
+
+// Go runs fn in a new goroutine under the supervisor's restart policy.
+// Every error or panic along the way is kept for Wait.
+
+func (s *Supervisor) Go(ctx context.Context, fn func(context.Context) error) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.run(ctx, fn)
+	}()
+}
+
+func (s *Supervisor) run(ctx context.Context, fn func(context.Context) error) {
+	backoff := s.options.Backoff
+	for restarts := 0; ; restarts++ {
+		err := call(ctx, fn)
+		if err != nil {
+			s.record(fmt.Errorf("run %v: %w", restarts+1, err))
+		} else {
+			backoff = s.options.Backoff
+		}
+		restart := s.options.Restart == Always ||
+			(s.options.Restart == OnFailure && err != nil)
+		if !restart || ctx.Err() != nil ||
+			(s.options.MaxRestarts > 0 && restarts >= s.options.MaxRestarts) {
+			return
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		backoff = min(backoff*2, s.options.MaxBackoff)
+	}
+}
+
+func (s *Supervisor) record(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failures++
+	if len(s.errs) == s.options.KeepErrors {
+		copy(s.errs, s.errs[1:])
+		s.errs = s.errs[:len(s.errs)-1]
+	}
+	s.errs = append(s.errs, err)
+}
+
+// Failures counts every error and panic so far, including those too old
+// to be kept.
+
+func (s *Supervisor) Failures() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.failures
+}
+
+// Wait blocks until every supervised goroutine has stopped for good and
+// returns the most recent errors joined, or nil if there were none. If
+// older errors were dropped, the first line says how many.
+
+func (s *Supervisor) Wait() error {
+	s.wg.Wait()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	errs := s.errs
+	if dropped := s.failures - len(s.errs); dropped > 0 {
+		errs = append([]error{fmt.Errorf("%v earlier errors not kept", dropped)}, errs...)
+	}
+	return errors.Join(errs...)
+}
+
+// Produce supervises a function that writes to out, and closes out once
+// the function has stopped for good - after its last restart, on error,
+// on panic or on cancellation - so a reader ranging over out always
+// finishes.
+
+func Produce[T any](s *Supervisor, ctx context.Context, out chan<- T,
+	fn func(context.Context, chan<- T) error) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(out)
+		s.run(ctx, func(ctx context.Context) error {
+			return fn(ctx, out)
+		})
+	}()
+}
@@ -0,0 +1,160 @@
+package supervisor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var errFailed = errors.New("failed")
+
+func quick(restart RestartPolicy, maxRestarts int) Options {
+	return Options{Restart: restart, MaxRestarts: maxRestarts,
+		Backoff: time.Microsecond, MaxBackoff: time.Microsecond}
+}
+
+// wait fails the test if Wait takes longer than a couple of seconds.
+
+func wait(t *testing.T, s *Supervisor) error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- s.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(2 * time.Second):
+		t.Fatal("Wait did not return")
+		return nil
+	}
+}
+
+func TestRestartLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+		fails   bool
+		runs    int64
+	}{
+		{"never", quick(Never, 5), true, 1},
+		{"on failure", quick(OnFailure, 2), true, 3},
+		{"on failure, succeeds", quick(OnFailure, 2), false, 1},
+		{"always", quick(Always, 3), false, 4},
+	}
+	for _, test := range tests {
+		var runs atomic.Int64
+		s := New(test.options)
+		s.Go(context.Background(), func(ctx context.Context) error {
+			runs.Add(1)
+			if test.fails {
+				return errFailed
+			}
+			return nil
+		})
+		err := wait(t, s)
+		if got := runs.Load(); got != test.runs {
+			t.Errorf("%v: %d runs, want %d", test.name, got, test.runs)
+		}
+		failures := 0
+		if test.fails {
+			failures = int(test.runs)
+		}
+		if test.fails != errors.Is(err, errFailed) || s.Failures() != failures {
+			t.Errorf("%v: Wait returned %v after %d failures", test.name, err, s.Failures())
+		}
+	}
+}
+
+func TestUnlimitedRestartsKeepRecentErrors(t *testing.T) {
+	options := quick(OnFailure, 0)
+	options.KeepErrors = 3
+	s := New(options)
+	var runs atomic.Int64
+	s.Go(context.Background(), func(ctx context.Context) error {
+		if runs.Add(1) <= 100 {
+			return errFailed
+		}
+		return nil
+	})
+	err := wait(t, s)
+	if runs.Load() != 101 || s.Failures() != 100 {
+		t.Fatalf("%d runs, %d failures", runs.Load(), s.Failures())
+	}
+	lines := strings.Split(err.Error(), "\n")
+	want := []string{"97 earlier errors not kept", "run 98: failed", "run 99: failed", "run 100: failed"}
+	if strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("Wait returned %q, want %q", lines, want)
+	}
+	if len(s.errs) != 3 {
+		t.Errorf("%d errors kept, want 3", len(s.errs))
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	s := New(quick(OnFailure, 1))
+	var runs atomic.Int64
+	s.Go(context.Background(), func(ctx context.Context) error {
+		if runs.Add(1) == 1 {
+			panic(errFailed)
+		}
+		panic("second")
+	})
+	err := wait(t, s)
+	if runs.Load() != 2 {
+		t.Errorf("%d runs, want 2", runs.Load())
+	}
+	if !errors.Is(err, errFailed) {
+		t.Errorf("errors.Is does not see the panic value in %v", err)
+	}
+	var panicErr *PanicError
+	if !errors.As(err, &panicErr) {
+		t.Fatalf("no PanicError in %v", err)
+	}
+	if panicErr.Error() != "panic: failed" {
+		t.Errorf("Error() is %q", panicErr.Error())
+	}
+	if !bytes.Contains(panicErr.Stack(), []byte("supervisor.TestPanicRecovery")) {
+		t.Errorf("stack does not show the panicking function:\n%s", panicErr.Stack())
+	}
+	if strings.Contains(err.Error(), "goroutine") {
+		t.Errorf("stack printed in the error message:\n%v", err)
+	}
+}
+
+func TestCancelStopsRestarts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := New(Options{Restart: Always, Backoff: time.Hour})
+	var runs atomic.Int64
+	s.Go(ctx, func(ctx context.Context) error {
+		runs.Add(1)
+		return nil
+	})
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := wait(t, s); err != nil || runs.Load() != 1 {
+		t.Errorf("cancelled during backoff: %d runs, %v", runs.Load(), err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	s = New(quick(Always, 0))
+	out := make(chan int)
+	Produce(s, ctx, out, func(ctx context.Context, out chan<- int) error {
+		select {
+		case out <- 1:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	<-out
+	<-out
+	cancel()
+	for range out {
+	}
+	if err := wait(t, s); err != nil && !errors.Is(err, context.Canceled) {
+		t.Errorf("Produce after cancel: %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const maxAPIBodySize = 1 << 20
+
+func writeJSON(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(value)
+}
+
+func writeJSONError(writer http.ResponseWriter, status int, message string) {
+	writeJSON(writer, status, map[string]string{"error": message})
+}
+
+// decodeProduct accepts the same shape the API sends, so a product can be
+// read, changed and sent back. The ID is ignored when creating (pathID is
+// 0) and must match the URL when updating.
+
+func decodeProduct(writer http.ResponseWriter, request *http.Request, pathID int) (Product, bool) {
+	var body struct {
+		ID *int
+		Product
+	}
+	decoder := json.NewDecoder(http.MaxBytesReader(writer, request.Body, maxAPIBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		writeJSONError(writer, http.StatusBadRequest, "Invalid product JSON: "+err.Error())
+		return body.Product, false
+	}
+	p := body.Product
+	if pathID != 0 && body.ID != nil && *body.ID != pathID {
+		writeJSONError(writer, http.StatusBadRequest,
+			fmt.Sprintf("ID %v in body does not match ID %v in URL", *body.ID, pathID))
+		return p, false
+	}
+	if problems := validateProduct(&p); len(problems) > 0 {
+		writeJSON(writer, http.StatusUnprocessableEntity, map[string]interface{}{"errors": problems})
+		return p, false
+	}
+	return p, true
+}
+
+func parsePriceParam(request *http.Request, name string, fallback float64) (float64, error) {
+	value := request.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	price, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%v must be a number", name)
+	}
+	return price, nil
+}
+
+func writeAPIRepositoryError(writer http.ResponseWriter, err error) bool {
+	if errors.Is(err, ErrProductNotFound) {
+		writeJSONError(writer, http.StatusNotFound, "No product with that ID")
+	} else if err != nil {
+		writeJSONError(writer, http.StatusInternalServerError, err.Error())
+	}
+	return err != nil
+}
+
+// parseID reads the {id} path value; an ID that isn't a number can't name
+// a product, so it is reported the same way as a missing one.
+
+func parseID(writer http.ResponseWriter, request *http.Request) (int, bool) {
+	id, err := strconv.Atoi(request.PathValue("id"))
+	if err != nil {
+		writeJSONError(writer, http.StatusNotFound, "No product with that ID")
+	}
+	return id, err == nil
+}
+
+// listProducts supports ?category= (case-insensitive) and the inclusive
+// ?minPrice= and ?maxPrice= bounds, in any combination.
+
+func (s *Server) listProducts(writer http.ResponseWriter, request *http.Request) {
+	category := request.URL.Query().Get("category")
+	minPrice, err := parsePriceParam(request, "minPrice", 0)
+	if err != nil {
+		writeJSONError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	maxPrice, err := parsePriceParam(request, "maxPrice", -1)
+	if err != nil {
+		writeJSONError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	resources := []StoredProduct{}
+	for _, p := range s.repo.All() {
+		if category != "" && !strings.EqualFold(p.Category, category) {
+			continue
+		}
+		if p.Price < minPrice || (maxPrice >= 0 && p.Price > maxPrice) {
+			continue
+		}
+		resources = append(resources, p)
+	}
+	writeJSON(writer, http.StatusOK, resources)
+}
+
+func (s *Server) createProduct(writer http.ResponseWriter, request *http.Request) {
+	if p, ok := decodeProduct(writer, request, 0); ok {
+		id, err := s.repo.Add(p)
+		if !writeAPIRepositoryError(writer, err) {
+			writer.Header().Set("Location", "/api/products/"+strconv.Itoa(id))
+			writeJSON(writer, http.StatusCreated, StoredProduct{ID: id, Product: p})
+		}
+	}
+}
+
+func (s *Server) getProduct(writer http.ResponseWriter, request *http.Request) {
+	if id, ok := parseID(writer, request); ok {
+		if p, found := s.repo.Get(id); found {
+			writeJSON(writer, http.StatusOK, StoredProduct{ID: id, Product: p})
+		} else {
+			writeJSONError(writer, http.StatusNotFound, "No product with that ID")
+		}
+	}
+}
+
+func (s *Server) updateProduct(writer http.ResponseWriter, request *http.Request) {
+	if id, ok := parseID(writer, request); ok {
+		if p, ok := decodeProduct(writer, request, id); ok {
+			if _, err := s.repo.Update(id, p); !writeAPIRepositoryError(writer, err) {
+				writeJSON(writer, http.StatusOK, StoredProduct{ID: id, Product: p})
+			}
+		}
+	}
+}
+
+func (s *Server) deleteProduct(writer http.ResponseWriter, request *http.Request) {
+	if id, ok := parseID(writer, request); ok {
+		if _, err := s.repo.Delete(id); !writeAPIRepositoryError(writer, err) {
+			writer.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSOptions says which other origins may call the server from
+// JavaScript. An origin is either matched exactly, written as a pattern
+// like "https://*.example.com" that matches any subdomain (but not
+// example.com itself), or "*" for any origin. "*" can't be combined with
+// AllowCredentials: that would let every site make requests carrying the
+// user's cookies and read the answers.
+
+type CORSOptions struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+func DefaultCORSOptions() CORSOptions {
+	return CORSOptions{
+		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+		AllowedHeaders: []string{"Content-Type", csrfHeaderName},
+		ExposedHeaders: []string{"Location"},
+		MaxAge:         10 * time.Minute,
+	}
+}
+
+type originPattern struct {
+	scheme, hostSuffix, port string
+}
+
+type corsPolicy struct {
+	options   CORSOptions
+	anyOrigin bool
+	exact     map[string]bool
+	patterns  []originPattern
+	methods   map[string]bool
+	headers   map[string]bool
+	anyHeader bool
+}
+
+var ErrCORSWildcardCredentials = errors.New(`CORS: the "*" origin can't be used with AllowCredentials`)
+
+func newCORSPolicy(options CORSOptions) (*corsPolicy, error) {
+	policy := &corsPolicy{
+		options: options,
+		exact:   map[string]bool{},
+		methods: map[string]bool{},
+		headers: map[string]bool{},
+	}
+	for _, origin := range options.AllowedOrigins {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		switch {
+		case origin == "*":
+			policy.anyOrigin = true
+		case strings.Contains(origin, "://*."):
+			scheme, host, _ := strings.Cut(origin, "://*.")
+			host, port, _ := strings.Cut(host, ":")
+			policy.patterns = append(policy.patterns, originPattern{
+				scheme: strings.ToLower(scheme), hostSuffix: "." + strings.ToLower(host), port: port,
+			})
+		case origin != "":
+			policy.exact[strings.ToLower(origin)] = true
+		}
+	}
+	for _, method := range options.AllowedMethods {
+		policy.methods[strings.ToUpper(method)] = true
+	}
+	for _, header := range options.AllowedHeaders {
+		if header == "*" {
+			policy.anyHeader = true
+		}
+		policy.headers[http.CanonicalHeaderKey(header)] = true
+	}
+	if policy.anyOrigin && options.AllowCredentials {
+		return nil, ErrCORSWildcardCredentials
+	}
+	return policy, nil
+}
+
+func (policy *corsPolicy) originAllowed(origin string) bool {
+	if policy.anyOrigin || policy.exact[strings.ToLower(origin)] {
+		return true
+	}
+	if len(policy.patterns) == 0 {
+		return false
+	}
+	parsed, err := url.Parse(origin)
+	if err != nil || parsed.Host == "" {
+		return false
+	}
+	host := strings.ToLower(parsed.Hostname())
+	for _, pattern := range policy.patterns {
+		if parsed.Scheme == pattern.scheme && parsed.Port() == pattern.port &&
+			strings.HasSuffix(host, pattern.hostSuffix) && len(host) > len(pattern.hostSuffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowOrigin is the value of Access-Control-Allow-Origin.
+
+func (policy *corsPolicy) allowOrigin(origin string) string {
+	if policy.anyOrigin {
+		return "*"
+	}
+	return origin
+}
+
+// requestedHeadersAllowed checks every header named in a preflight's
+// Access-Control-Request-Headers.
+
+func (policy *corsPolicy) requestedHeadersAllowed(requested string) bool {
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+		if !policy.headers[http.CanonicalHeaderKey(header)] &&
+			!(policy.anyHeader && !policy.options.AllowCredentials) {
+			return false
+		}
+	}
+	return true
+}
+
+func (policy *corsPolicy) preflight(writer http.ResponseWriter, request *http.Request) {
+	header := writer.Header()
+	header.Add("Vary", "Origin")
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+
+	origin := request.Header.Get("Origin")
+	method := strings.ToUpper(request.Header.Get("Access-Control-Request-Method"))
+	requestedHeaders := request.Header.Get("Access-Control-Request-Headers")
+	if !policy.originAllowed(origin) || !policy.methods[method] ||
+		!policy.requestedHeadersAllowed(requestedHeaders) {
+		writer.WriteHeader(http.StatusForbidden)
+		return
+	}
+	header.Set("Access-Control-Allow-Origin", policy.allowOrigin(origin))
+	header.Set("Access-Control-Allow-Methods", strings.Join(policy.options.AllowedMethods, ", "))
+	if requestedHeaders != "" {
+		header.Set("Access-Control-Allow-Headers", requestedHeaders)
+	}
+	if policy.options.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if policy.options.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(policy.options.MaxAge.Seconds())))
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// CORS answers preflight requests itself and adds the CORS headers to
+// every other response for an allowed origin. Requests from origins that
+// aren't allowed are passed on untouched, so the browser blocks them.
+
+func CORS(options CORSOptions) (Middleware, error) {
+	policy, err := newCORSPolicy(options)
+	if err != nil {
+		return nil, err
+	}
+	return policy.middleware, nil
+}
+
+func (policy *corsPolicy) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		origin := request.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		if request.Method == http.MethodOptions &&
+			request.Header.Get("Access-Control-Request-Method") != "" {
+			policy.preflight(writer, request)
+			return
+		}
+		header := writer.Header()
+		header.Add("Vary", "Origin")
+		if policy.originAllowed(origin) {
+			header.Set("Access-Control-Allow-Origin", policy.allowOrigin(origin))
+			if policy.options.AllowCredentials {
+				header.Set("Access-Control-Allow-Credentials", "true")
+			}
+			if len(policy.options.ExposedHeaders) > 0 {
+				header.Set("Access-Control-Expose-Headers", strings.Join(policy.options.ExposedHeaders, ", "))
+			}
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
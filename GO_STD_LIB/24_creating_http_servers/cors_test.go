@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func corsHandler(t *testing.T, options CORSOptions) http.Handler {
+	t.Helper()
+	middleware, err := CORS(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return middleware(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("ok"))
+	}))
+}
+
+func corsOptions(origins ...string) CORSOptions {
+	options := DefaultCORSOptions()
+	options.AllowedOrigins = origins
+	return options
+}
+
+func TestCORSSimpleRequests(t *testing.T) {
+	handler := corsHandler(t, corsOptions("https://shop.example.com", "https://*.partner.com"))
+	tests := []struct {
+		origin string
+		allow  string
+	}{
+		{"https://shop.example.com", "https://shop.example.com"},
+		{"https://SHOP.example.com", "https://SHOP.example.com"},
+		{"https://evil.com", ""},
+		{"http://shop.example.com", ""},
+		{"https://a.partner.com", "https://a.partner.com"},
+		{"https://a.b.partner.com", "https://a.b.partner.com"},
+		{"https://partner.com", ""},
+		{"https://evilpartner.com", ""},
+		{"http://a.partner.com", ""},
+		{"https://a.partner.com:8443", ""},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", "/api/products", nil)
+		request.Header.Set("Origin", test.origin)
+		response := serve(handler, request)
+		if response.Code != http.StatusOK {
+			t.Errorf("%s: status %d, want 200", test.origin, response.Code)
+		}
+		if got := response.Header().Get("Access-Control-Allow-Origin"); got != test.allow {
+			t.Errorf("%s: Access-Control-Allow-Origin %q, want %q", test.origin, got, test.allow)
+		}
+		if got := response.Header().Get("Vary"); got != "Origin" {
+			t.Errorf("%s: Vary %q, want Origin", test.origin, got)
+		}
+		if test.allow != "" && response.Header().Get("Access-Control-Expose-Headers") != "Location" {
+			t.Errorf("%s: Location not exposed", test.origin)
+		}
+	}
+}
+
+func TestCORSWithoutOriginIsUntouched(t *testing.T) {
+	handler := corsHandler(t, corsOptions("https://shop.example.com"))
+	response := serve(handler, httptest.NewRequest("GET", "/", nil))
+	if len(response.Header().Values("Vary")) != 0 ||
+		response.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("same-origin request got CORS headers: %v", response.Header())
+	}
+}
+
+func TestCORSAnyOrigin(t *testing.T) {
+	handler := corsHandler(t, corsOptions("*"))
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Origin", "https://anywhere.net")
+	response := serve(handler, request)
+	if got := response.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin %q, want *", got)
+	}
+	if got := response.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("Access-Control-Allow-Credentials %q, want none", got)
+	}
+}
+
+func TestCORSRejectsAnyOriginWithCredentials(t *testing.T) {
+	options := corsOptions("https://shop.example.com", "*")
+	options.AllowCredentials = true
+	if _, err := CORS(options); !errors.Is(err, ErrCORSWildcardCredentials) {
+		t.Errorf("CORS: got %v, want ErrCORSWildcardCredentials", err)
+	}
+	cfg := testConfig(t)
+	cfg.CORS = options
+	if _, err := NewServer(cfg, NewMemoryProductRepository(Products)); !errors.Is(err, ErrCORSWildcardCredentials) {
+		t.Errorf("NewServer: got %v, want ErrCORSWildcardCredentials", err)
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	options := corsOptions("https://shop.example.com", "https://*.partner.com")
+	options.AllowCredentials = true
+	options.MaxAge = 90 * time.Second
+	handler := corsHandler(t, options)
+
+	tests := []struct {
+		name    string
+		origin  string
+		method  string
+		headers string
+		status  int
+	}{
+		{"allowed", "https://shop.example.com", "PUT", "content-type, x-csrf-token", http.StatusNoContent},
+		{"no_headers", "https://shop.example.com", "DELETE", "", http.StatusNoContent},
+		{"subdomain", "https://a.partner.com", "post", "Content-Type", http.StatusNoContent},
+		{"bad_origin", "https://evil.com", "PUT", "Content-Type", http.StatusForbidden},
+		{"bad_method", "https://shop.example.com", "PATCH", "Content-Type", http.StatusForbidden},
+		{"bad_header", "https://shop.example.com", "PUT", "Content-Type, X-Secret", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest("OPTIONS", "/api/products/1", nil)
+			request.Header.Set("Origin", test.origin)
+			request.Header.Set("Access-Control-Request-Method", test.method)
+			if test.headers != "" {
+				request.Header.Set("Access-Control-Request-Headers", test.headers)
+			}
+			response := serve(handler, request)
+			if response.Code != test.status {
+				t.Fatalf("status %d, want %d", response.Code, test.status)
+			}
+			if response.Body.Len() != 0 {
+				t.Errorf("preflight reached the handler: %q", response.Body)
+			}
+			header := response.Header()
+			if test.status == http.StatusForbidden {
+				if header.Get("Access-Control-Allow-Origin") != "" {
+					t.Errorf("refused preflight has Access-Control-Allow-Origin %q", header.Get("Access-Control-Allow-Origin"))
+				}
+				return
+			}
+			want := map[string]string{
+				"Access-Control-Allow-Origin":      test.origin,
+				"Access-Control-Allow-Methods":     "GET, POST, PUT, DELETE",
+				"Access-Control-Allow-Headers":     test.headers,
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Max-Age":           "90",
+			}
+			for name, value := range want {
+				if got := header.Get(name); got != value {
+					t.Errorf("%s %q, want %q", name, got, value)
+				}
+			}
+		})
+	}
+}
+
+func TestCORSCredentialsOnSimpleRequest(t *testing.T) {
+	options := corsOptions("https://shop.example.com")
+	options.AllowCredentials = true
+	handler := corsHandler(t, options)
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Origin", "https://shop.example.com")
+	response := serve(handler, request)
+	if got := response.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("Access-Control-Allow-Credentials %q, want true", got)
+	}
+	if got := response.Header().Get("Access-Control-Max-Age"); got != "" {
+		t.Errorf("simple response has Access-Control-Max-Age %q", got)
+	}
+}
+
+func TestCORSOptionsWithoutPreflightReachHandler(t *testing.T) {
+	handler := corsHandler(t, corsOptions("https://shop.example.com"))
+	request := httptest.NewRequest("OPTIONS", "/", nil)
+	request.Header.Set("Origin", "https://shop.example.com")
+	response := serve(handler, request)
+	if response.Body.String() != "ok" {
+		t.Errorf("plain OPTIONS was treated as a preflight: %d %q", response.Code, response.Body)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Context is the value passed to every template, so templates can
+// inspect the request (query string, form values) as well as the data.
+
+type Context struct {
+	Request   *http.Request
+	Data      interface{}
+	Flashes   []string
+	csrfToken func() string
+}
+
+// CSRFToken is called by templates with forms. Templates are rendered
+// into a buffer before anything is written, so the session cookie can
+// still be set at this point.
+
+func (ctx Context) CSRFToken() string {
+	if ctx.csrfToken == nil {
+		return ""
+	}
+	return ctx.csrfToken()
+}
+
+var templateFuncs = template.FuncMap{
+	"intVal": strconv.Atoi,
+}
+
+// TemplateCache parses every html file in a folder once and keeps the
+// result. In dev mode the folder is checked on each lookup and the
+// templates are parsed again when a file has been added or modified.
+
+type TemplateCache struct {
+	pattern     string
+	devMode     bool
+	mutex       sync.RWMutex
+	loaded      *template.Template
+	fingerprint string
+}
+
+func NewTemplateCache(dir string, devMode bool) (*TemplateCache, error) {
+	cache := &TemplateCache{
+		pattern: filepath.Join(dir, "*.html"),
+		devMode: devMode,
+	}
+	return cache, cache.load()
+}
+
+func (cache *TemplateCache) load() error {
+	fingerprint := cache.currentFingerprint()
+	t, err := template.New("all").Funcs(templateFuncs).ParseGlob(cache.pattern)
+	if err != nil {
+		return err
+	}
+	cache.mutex.Lock()
+	cache.loaded, cache.fingerprint = t, fingerprint
+	cache.mutex.Unlock()
+	return nil
+}
+
+// currentFingerprint lists the name, size and modification time of every
+// template file, so adding, removing or editing a file changes the result.
+
+func (cache *TemplateCache) currentFingerprint() string {
+	files, _ := filepath.Glob(cache.pattern)
+	var builder strings.Builder
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			fmt.Fprintf(&builder, "%v:%v:%v;", file, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return builder.String()
+}
+
+func (cache *TemplateCache) changed() bool {
+	fingerprint := cache.currentFingerprint()
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	return fingerprint != cache.fingerprint
+}
+
+func (cache *TemplateCache) Lookup(name string) (*template.Template, error) {
+	if cache.devMode && cache.changed() {
+		if err := cache.load(); err != nil {
+			return nil, err
+		}
+	}
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	return cache.loaded.Lookup(name), nil
+}
+
+// Render executes the named template and reports failures as server errors.
+
+func (cache *TemplateCache) Render(writer http.ResponseWriter, name string, ctx Context) {
+	cache.RenderStatus(writer, http.StatusOK, name, ctx)
+}
+
+// RenderStatus executes the template into a buffer before anything is
+// written, so a failing template still produces a clean error response.
+
+func (cache *TemplateCache) RenderStatus(writer http.ResponseWriter, status int, name string, ctx Context) {
+	t, err := cache.Lookup(name)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if t == nil {
+		http.Error(writer, "Template not found: "+name, http.StatusNotFound)
+		return
+	}
+	var buffer bytes.Buffer
+	if err := t.Execute(&buffer, ctx); err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.WriteHeader(status)
+	buffer.WriteTo(writer)
+}
+
+// pageData lists the templates that can be requested directly under
+// /templates/ and builds the data each one expects. The others, such as
+// edit.html and uploads.html, need data only their own handlers have, so
+// they are not found here.
+
+func (s *Server) pageData(name string) (data interface{}, ok bool) {
+	switch name {
+	case "store.html":
+		return s.repo.All(), true
+	case "upload.html":
+		return nil, true
+	}
+	return nil, false
+}
+
+// handleTemplatePage renders a directly viewable page by name;
+// /templates/ on its own shows the store page.
+
+func (s *Server) handleTemplatePage(writer http.ResponseWriter, request *http.Request) {
+	name := request.PathValue("name")
+	if name == "" {
+		name = "store.html"
+	}
+	data, ok := s.pageData(name)
+	if !ok {
+		http.NotFound(writer, request)
+		return
+	}
+	SendEarlyHints(writer, request, preloadLinks...)
+	s.templates.Render(writer, name, s.newContext(writer, request, data))
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	EventCreate = "create"
+	EventUpdate = "update"
+	EventDelete = "delete"
+)
+
+// ProductEvent describes one change to the repository. IDs increase by
+// one per event, so a client that knows the last ID it saw can ask for
+// everything after it. ProductID is the repository ID of the product.
+// PreviousCategory is set when an update moves the product out of a
+// category, so clients watching that category hear about it too.
+
+type ProductEvent struct {
+	ID               uint64
+	Type             string
+	ProductID        int
+	Product          Product
+	PreviousCategory string `json:",omitempty"`
+}
+
+// EventSubscription is returned by EventBroker.Subscribe. Replay holds the
+// buffered events the subscriber missed; Reset is set instead when some
+// of them have already been dropped from the buffer, so the subscriber
+// must reload everything. Events is closed when the subscription ends.
+
+type EventSubscription struct {
+	Events <-chan ProductEvent
+	Replay []ProductEvent
+	Reset  bool
+	cancel func()
+}
+
+func (sub *EventSubscription) Close() {
+	sub.cancel()
+}
+
+// EventBroker fans product events out to every subscriber and keeps the
+// most recent ones for resuming. A subscriber that falls behind by more
+// than its buffer is disconnected rather than slowing down publishers;
+// it can reconnect and resume from the last event it received.
+
+type EventBroker struct {
+	mutex       sync.Mutex
+	nextID      uint64
+	history     []ProductEvent
+	historySize int
+	bufferSize  int
+	subscribers map[chan ProductEvent]bool
+}
+
+func NewEventBroker(historySize, bufferSize int) *EventBroker {
+	return &EventBroker{
+		nextID:      1,
+		historySize: historySize,
+		bufferSize:  bufferSize,
+		subscribers: map[chan ProductEvent]bool{},
+	}
+}
+
+// Publish gives event the next ID and sends it to every subscriber.
+
+func (b *EventBroker) Publish(event ProductEvent) ProductEvent {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	event.ID = b.nextID
+	b.nextID++
+	b.history = append(b.history, event)
+	if len(b.history) > b.historySize {
+		b.history = b.history[len(b.history)-b.historySize:]
+	}
+	for channel := range b.subscribers {
+		select {
+		case channel <- event:
+		default:
+			delete(b.subscribers, channel)
+			close(channel)
+		}
+	}
+	return event
+}
+
+// Subscribe starts delivering events published from now on. A lastID of
+// zero means the subscriber has seen nothing and wants no replay.
+
+func (b *EventBroker) Subscribe(lastID uint64) *EventSubscription {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	channel := make(chan ProductEvent, b.bufferSize)
+	b.subscribers[channel] = true
+	sub := &EventSubscription{Events: channel}
+	sub.cancel = func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		if b.subscribers[channel] {
+			delete(b.subscribers, channel)
+			close(channel)
+		}
+	}
+	// An ID from the future means the server restarted since the client
+	// last connected, so its view can't be patched up from the buffer.
+	if lastID >= b.nextID {
+		sub.Reset = true
+	} else if lastID > 0 && lastID < b.nextID-1 {
+		if len(b.history) == 0 || b.history[0].ID > lastID+1 {
+			sub.Reset = true
+		} else {
+			for _, event := range b.history {
+				if event.ID > lastID {
+					sub.Replay = append(sub.Replay, event)
+				}
+			}
+		}
+	}
+	return sub
+}
+
+// ObservableRepository publishes an event for every successful change
+// made through it, so the SSE stream sees edits from forms and API alike.
+// Each change is published before the next one is made, so subscribers
+// see changes in the order they were applied.
+
+type ObservableRepository struct {
+	ProductRepository
+	events *EventBroker
+	mutex  sync.Mutex
+}
+
+func NewObservableRepository(repo ProductRepository, events *EventBroker) *ObservableRepository {
+	return &ObservableRepository{ProductRepository: repo, events: events}
+}
+
+func (repo *ObservableRepository) Add(p Product) (int, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	id, err := repo.ProductRepository.Add(p)
+	if err == nil {
+		repo.events.Publish(ProductEvent{Type: EventCreate, ProductID: id, Product: p})
+	}
+	return id, err
+}
+
+func (repo *ObservableRepository) Update(id int, p Product) (Product, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	previous, err := repo.ProductRepository.Update(id, p)
+	if err == nil {
+		event := ProductEvent{Type: EventUpdate, ProductID: id, Product: p}
+		if previous.Category != p.Category {
+			event.PreviousCategory = previous.Category
+		}
+		repo.events.Publish(event)
+	}
+	return previous, err
+}
+
+func (repo *ObservableRepository) Delete(id int) (Product, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	removed, err := repo.ProductRepository.Delete(id)
+	if err == nil {
+		repo.events.Publish(ProductEvent{Type: EventDelete, ProductID: id, Product: removed})
+	}
+	return removed, err
+}
+
+const sseHeartbeat = 15 * time.Second
+
+func writeSSEEvent(writer http.ResponseWriter, event ProductEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(writer, "id: %d\nevent: product\ndata: %s\n\n", event.ID, data)
+	return err
+}
+
+// handleEvents streams product changes as Server-Sent Events. Browsers
+// send Last-Event-ID when they reconnect; the missed events are replayed
+// from the broker's buffer, or a reset event tells the page to reload the
+// whole list when they are no longer available. Comment lines are sent
+// as heartbeats so idle proxies don't close the connection.
+
+func (s *Server) handleEvents(writer http.ResponseWriter, request *http.Request) {
+	controller := http.NewResponseController(writer)
+	lastID, _ := strconv.ParseUint(request.Header.Get("Last-Event-ID"), 10, 64)
+	sub := s.events.Subscribe(lastID)
+	defer sub.Close()
+
+	header := writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	writer.WriteHeader(http.StatusOK)
+
+	fmt.Fprint(writer, "retry: 3000\n\n")
+	if sub.Reset {
+		fmt.Fprint(writer, "event: reset\ndata: {}\n\n")
+	}
+	for _, event := range sub.Replay {
+		if writeSSEEvent(writer, event) != nil {
+			return
+		}
+	}
+	if controller.Flush() != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-request.Context().Done():
+			return
+		case event, open := <-sub.Events:
+			if !open || writeSSEEvent(writer, event) != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(writer, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		if controller.Flush() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// recordingRepository notes the name of every product it stores, in the
+// order the changes were applied.
+
+type recordingRepository struct {
+	ProductRepository
+	mutex   sync.Mutex
+	applied []string
+}
+
+func (repo *recordingRepository) Update(id int, p Product) (Product, error) {
+	previous, err := repo.ProductRepository.Update(id, p)
+	repo.mutex.Lock()
+	repo.applied = append(repo.applied, p.Name)
+	repo.mutex.Unlock()
+	return previous, err
+}
+
+func TestObservableRepositoryPublishesInOrder(t *testing.T) {
+	inner := &recordingRepository{ProductRepository: NewMemoryProductRepository(Products)}
+	broker := NewEventBroker(200, 200)
+	repo := NewObservableRepository(inner, broker)
+	sub := broker.Subscribe(0)
+	defer sub.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			repo.Update(1, Product{Name: "name " + strconv.Itoa(i), Category: "Watersports", Price: 1})
+		}(i)
+	}
+	wg.Wait()
+
+	for i, name := range inner.applied {
+		event := <-sub.Events
+		if event.Product.Name != name {
+			t.Fatalf("event %d is %q, but %q was applied", i, event.Product.Name, name)
+		}
+	}
+	if p, _ := repo.Get(1); p.Name != inner.applied[len(inner.applied)-1] {
+		t.Errorf("stored %q, last applied %q", p.Name, inner.applied[len(inner.applied)-1])
+	}
+}
+
+func TestObservableRepositoryDelete(t *testing.T) {
+	broker := NewEventBroker(10, 10)
+	repo := NewObservableRepository(NewMemoryProductRepository(Products), broker)
+	sub := broker.Subscribe(0)
+	defer sub.Close()
+
+	removed, err := repo.Delete(2)
+	if err != nil || removed != Products[1] {
+		t.Fatalf("Delete(2) = %v, %v", removed, err)
+	}
+	if event := <-sub.Events; event.Type != EventDelete || event.ProductID != 2 || event.Product != Products[1] {
+		t.Errorf("event %+v", event)
+	}
+	if _, err := repo.Delete(2); !errors.Is(err, ErrProductNotFound) {
+		t.Errorf("second delete: %v", err)
+	}
+	previous, err := repo.Update(1, Product{Name: "Canoe", Category: "Watersports", Price: 10})
+	if err != nil || previous != Products[0] {
+		t.Errorf("Update(1) returned %v, %v", previous, err)
+	}
+	if event := <-sub.Events; event.Type != EventUpdate {
+		t.Errorf("failed delete published an event, then %+v", event)
+	}
+}
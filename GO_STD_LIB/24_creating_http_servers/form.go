@@ -1,21 +1,188 @@
 package main
 
 import (
+	"errors"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
-func ProcessFormData(writer http.ResponseWriter, request *http.Request) {
-	if request.Method == http.MethodPost {
-		index, _ := strconv.Atoi(request.PostFormValue("index"))
-		p := Product{}
-		p.Name = request.PostFormValue("name")
-		p.Category = request.PostFormValue("category")
-		p.Price, _ = strconv.ParseFloat(request.PostFormValue("price"), 64)
-		Products[index] = p
+// ProductForm holds the raw values of the edit form, so they can be shown
+// again, exactly as typed, next to the errors that rejected them.
+// An ID of -1 means the form creates a new product.
+
+type ProductForm struct {
+	ID                    int
+	Name, Category, Price string
+	Errors                map[string]string
+}
+
+func (form ProductForm) IsNew() bool {
+	return form.ID == -1
+}
+
+func (form ProductForm) Valid() bool {
+	return len(form.Errors) == 0
+}
+
+const maxProductFieldLength = 100
+
+// parseFormID accepts the ID of an existing product or, when allowNew is
+// set, the -1 placeholder for a new one.
+
+func parseFormID(repo ProductRepository, value string, allowNew bool) (int, bool) {
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		return id, false
+	}
+	if allowNew && id == -1 {
+		return id, true
+	}
+	_, found := repo.Get(id)
+	return id, found
+}
+
+// editPageID reads the product to edit from ?id=. Older links use
+// ?index=, the product's position in the list, which is looked up here
+// once; the page then carries the ID, so the save can't land on another
+// product if the list changes in the meantime.
+
+func editPageID(repo ProductRepository, request *http.Request) (int, bool) {
+	if value := request.FormValue("id"); value != "" || request.FormValue("index") == "" {
+		return parseFormID(repo, value, true)
+	}
+	index, err := strconv.Atoi(request.FormValue("index"))
+	if err != nil {
+		return index, false
+	}
+	if index == -1 {
+		return -1, true
+	}
+	products := repo.All()
+	if index < 0 || index >= len(products) {
+		return index, false
+	}
+	return products[index].ID, true
+}
+
+func productFormFor(repo ProductRepository, id int) (ProductForm, bool) {
+	form := ProductForm{ID: id}
+	if !form.IsNew() {
+		p, found := repo.Get(id)
+		if !found {
+			return form, false
+		}
+		form.Name, form.Category = p.Name, p.Category
+		form.Price = strconv.FormatFloat(p.Price, 'f', -1, 64)
 	}
-	http.Redirect(writer, request, "/templates", http.StatusTemporaryRedirect)
+	return form, true
 }
-func init() {
-	http.HandleFunc("/forms/edit", ProcessFormData)
+
+// validateProduct trims the text fields and checks them along with the
+// price. The form handler and the REST API share these rules, and both
+// report problems keyed by lower-case field name.
+
+func validateProduct(p *Product) map[string]string {
+	problems := map[string]string{}
+	p.Name = strings.TrimSpace(p.Name)
+	p.Category = strings.TrimSpace(p.Category)
+	if p.Name == "" {
+		problems["name"] = "Name is required"
+	} else if len(p.Name) > maxProductFieldLength {
+		problems["name"] = "Name must be 100 characters or fewer"
+	}
+	if p.Category == "" {
+		problems["category"] = "Category is required"
+	} else if len(p.Category) > maxProductFieldLength {
+		problems["category"] = "Category must be 100 characters or fewer"
+	}
+	if math.IsNaN(p.Price) || math.IsInf(p.Price, 0) {
+		problems["price"] = "Price must be a number"
+	} else if p.Price < 0 {
+		problems["price"] = "Price cannot be negative"
+	}
+	return problems
+}
+
+// validate checks every field and returns the product the form describes.
+// Each problem is recorded against its field name in form.Errors.
+
+func (form *ProductForm) validate() Product {
+	p := Product{Name: form.Name, Category: form.Category}
+	price, err := strconv.ParseFloat(strings.TrimSpace(form.Price), 64)
+	p.Price = price
+	form.Errors = validateProduct(&p)
+	if err != nil {
+		form.Errors["price"] = "Price must be a number"
+	}
+	return p
+}
+
+func (s *Server) handleEditPage(writer http.ResponseWriter, request *http.Request) {
+	ctx := s.newContext(writer, request, nil)
+	id, ok := editPageID(s.repo, request)
+	form, found := productFormFor(s.repo, id)
+	if !ok || !found {
+		s.templates.RenderStatus(writer, http.StatusNotFound, "edit.html", ctx)
+		return
+	}
+	ctx.Data = form
+	SendEarlyHints(writer, request, preloadLinks...)
+	s.templates.Render(writer, "edit.html", ctx)
+}
+
+func (s *Server) processEditForm(writer http.ResponseWriter, request *http.Request) {
+	id, ok := parseFormID(s.repo, request.PostFormValue("id"), true)
+	if !ok {
+		http.Error(writer, "No product with specified ID", http.StatusNotFound)
+		return
+	}
+	form := ProductForm{
+		ID:       id,
+		Name:     request.PostFormValue("name"),
+		Category: request.PostFormValue("category"),
+		Price:    request.PostFormValue("price"),
+	}
+	p := form.validate()
+	if !form.Valid() {
+		s.templates.RenderStatus(writer, http.StatusUnprocessableEntity, "edit.html",
+			s.newContext(writer, request, form))
+		return
+	}
+	var err error
+	if form.IsNew() {
+		_, err = s.repo.Add(p)
+	} else {
+		_, err = s.repo.Update(id, p)
+	}
+	if !writeRepositoryError(writer, err) {
+		s.addFlash(writer, request, "Product saved")
+		http.Redirect(writer, request, "/templates/", http.StatusSeeOther)
+	}
+}
+
+func (s *Server) processDeleteForm(writer http.ResponseWriter, request *http.Request) {
+	id, err := strconv.Atoi(request.PostFormValue("id"))
+	if err != nil {
+		err = ErrProductNotFound
+	} else {
+		_, err = s.repo.Delete(id)
+	}
+	if !writeRepositoryError(writer, err) {
+		s.addFlash(writer, request, "Product deleted")
+		http.Redirect(writer, request, "/templates/", http.StatusSeeOther)
+	}
+}
+
+// writeRepositoryError reports a failed repository change to the browser
+// and returns false when there was nothing to report.
+
+func writeRepositoryError(writer http.ResponseWriter, err error) bool {
+	if errors.Is(err, ErrProductNotFound) {
+		http.Error(writer, "No product with specified ID", http.StatusNotFound)
+	} else if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+	}
+	return err != nil
 }
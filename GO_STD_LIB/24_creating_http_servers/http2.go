@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// TLSProtocols turns on HTTP/2 alongside HTTP/1.1 for HTTPS listeners.
+// Clients pick one during the TLS handshake using ALPN.
+
+func TLSProtocols() *http.Protocols {
+	protocols := &http.Protocols{}
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	return protocols
+}
+
+// CleartextProtocols serves HTTP/1.1 on a plain listener and, when h2c is
+// set, HTTP/2 without TLS as well. Go only accepts h2c "with prior
+// knowledge", which is what proxies use when they talk HTTP/2 to a
+// backend; the HTTP/1.1 Upgrade: h2c dance is not supported.
+
+func CleartextProtocols(h2c bool) *http.Protocols {
+	protocols := &http.Protocols{}
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(h2c)
+	return protocols
+}
+
+// preloadLinks are the resources every html page needs first.
+
+var preloadLinks = []string{
+	"</files/bootstrap.min.css>; rel=preload; as=style",
+}
+
+// SendEarlyHints adds Link preload headers to an html page and sends them
+// ahead of it in a 103 Early Hints response, so the browser can start
+// fetching the stylesheet while the template is still being rendered.
+// Handlers call it only once they know they will render the page, so
+// 404s and redirects don't advertise assets they never use. Server push
+// is not used; browsers have dropped support for it.
+
+func SendEarlyHints(writer http.ResponseWriter, request *http.Request, links ...string) {
+	if request.Method != http.MethodGet ||
+		!strings.Contains(request.Header.Get("Accept"), "text/html") {
+		return
+	}
+	for _, link := range links {
+		writer.Header().Add("Link", link)
+	}
+	writer.WriteHeader(http.StatusEarlyHints)
+}
+
+// ListenAndServe runs the server over HTTPS, with the HTTP port redirecting
+// to it, when cfg.UseTLS is set, and over plain HTTP (and h2c when
+// cfg.H2C is set) otherwise.
+
+func (s *Server) ListenAndServe() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.sessions.RunSweeper(ctx, sessionSweepEvery)
+	if s.cfg.UseTLS {
+		return ListenAndServeWithTLS(s.cfg.TLS, s)
+	}
+	server := &http.Server{
+		Addr:      ":" + strconv.Itoa(s.cfg.TLS.HTTPPort),
+		Handler:   s,
+		Protocols: CleartextProtocols(s.cfg.H2C),
+	}
+	return server.ListenAndServe()
+}
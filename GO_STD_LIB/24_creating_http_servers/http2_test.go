@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"testing"
+)
+
+// startTLSServer runs the product server the way ListenAndServeWithTLS
+// does: TLSProtocols, with both h2 and http/1.1 offered through ALPN.
+
+func startTLSServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewUnstartedServer(newTestServer(t, testConfig(t)))
+	ts.EnableHTTP2 = true
+	ts.Config.Protocols = TLSProtocols()
+	ts.TLS = &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func startCleartextServer(t *testing.T, h2c bool) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewUnstartedServer(newTestServer(t, testConfig(t)))
+	ts.Config.Protocols = CleartextProtocols(h2c)
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func protocols(http1, http2, h2c bool) *http.Protocols {
+	protocols := &http.Protocols{}
+	protocols.SetHTTP1(http1)
+	protocols.SetHTTP2(http2)
+	protocols.SetUnencryptedHTTP2(h2c)
+	return protocols
+}
+
+// clientWith returns a client for ts that only speaks the given protocols.
+// The test client's ALPN list is dropped so the transport builds its own.
+
+func clientWith(ts *httptest.Server, protocols *http.Protocols) *http.Client {
+	transport := ts.Client().Transport.(*http.Transport).Clone()
+	transport.Protocols = protocols
+	transport.ForceAttemptHTTP2 = false
+	if transport.TLSClientConfig != nil {
+		transport.TLSClientConfig.NextProtos = nil
+	}
+	return &http.Client{Transport: transport}
+}
+
+func getProto(t *testing.T, client *http.Client, url string) int {
+	t.Helper()
+	response, err := client.Get(url + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", response.StatusCode)
+	}
+	return response.ProtoMajor
+}
+
+func TestTLSNegotiatesHTTP2(t *testing.T) {
+	ts := startTLSServer(t)
+	if proto := getProto(t, ts.Client(), ts.URL); proto != 2 {
+		t.Errorf("ProtoMajor %d, want 2", proto)
+	}
+}
+
+func TestTLSFallsBackToHTTP1(t *testing.T) {
+	ts := startTLSServer(t)
+	client := clientWith(ts, protocols(true, false, false))
+	if proto := getProto(t, client, ts.URL); proto != 1 {
+		t.Errorf("ProtoMajor %d, want 1", proto)
+	}
+}
+
+func TestH2CPriorKnowledge(t *testing.T) {
+	ts := startCleartextServer(t, true)
+	if proto := getProto(t, clientWith(ts, protocols(false, false, true)), ts.URL); proto != 2 {
+		t.Errorf("h2c: ProtoMajor %d, want 2", proto)
+	}
+	if proto := getProto(t, clientWith(ts, protocols(true, false, false)), ts.URL); proto != 1 {
+		t.Errorf("HTTP/1.1 on an h2c listener: ProtoMajor %d, want 1", proto)
+	}
+}
+
+func TestH2COffByDefault(t *testing.T) {
+	ts := startCleartextServer(t, false)
+	response, err := clientWith(ts, protocols(false, false, true)).Get(ts.URL + "/healthz")
+	if err == nil {
+		response.Body.Close()
+		t.Fatalf("h2c request succeeded with ProtoMajor %d", response.ProtoMajor)
+	}
+}
+
+// getWithHints fetches path as a browser would and returns the Link
+// headers of any 103 responses along with the final response.
+
+func getWithHints(t *testing.T, ts *httptest.Server, path string) (*http.Response, []string) {
+	t.Helper()
+	var hints []string
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusEarlyHints {
+				hints = append(hints, header.Values("Link")...)
+			}
+			return nil
+		},
+	}
+	request, _ := http.NewRequest("GET", ts.URL+path, nil)
+	request = request.WithContext(httptrace.WithClientTrace(request.Context(), trace))
+	request.Header.Set("Accept", "text/html")
+	client := ts.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	return response, hints
+}
+
+func TestEarlyHintsOverHTTP2(t *testing.T) {
+	ts := startTLSServer(t)
+	response, hints := getWithHints(t, ts, "/templates/store.html")
+	if response.ProtoMajor != 2 || response.StatusCode != http.StatusOK {
+		t.Fatalf("got %v %d, want HTTP/2 200", response.Proto, response.StatusCode)
+	}
+	if len(hints) != len(preloadLinks) || hints[0] != preloadLinks[0] {
+		t.Errorf("103 Link headers %q, want %q", hints, preloadLinks)
+	}
+}
+
+func TestEarlyHintsOnlyForRenderedPages(t *testing.T) {
+	ts := startTLSServer(t)
+	tests := []struct {
+		path   string
+		status int
+		hinted bool
+	}{
+		{"/templates/", http.StatusOK, true},
+		{"/templates/edit.html?id=1", http.StatusOK, true},
+		{"/templates/missing.html", http.StatusNotFound, false},
+		{"/templates/edit.html?id=999", http.StatusNotFound, false},
+		{"/templates", http.StatusMovedPermanently, false},
+		{"/", http.StatusTemporaryRedirect, false},
+		{"/files/missing.css", http.StatusNotFound, false},
+	}
+	for _, test := range tests {
+		response, hints := getWithHints(t, ts, test.path)
+		if response.StatusCode != test.status {
+			t.Errorf("%v: status %d, want %d", test.path, response.StatusCode, test.status)
+		}
+		if hinted := len(hints) > 0; hinted != test.hinted {
+			t.Errorf("%v: sent early hints %q", test.path, hints)
+		}
+	}
+}
@@ -5,10 +5,11 @@ import (
 	"net/http"
 )
 
-func HandleJsonRequest(writer http.ResponseWriter, request *http.Request) {
+func (s *Server) handleJSON(writer http.ResponseWriter, request *http.Request) {
 	writer.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(writer).Encode(Products)
-}
-func init() {
-	http.HandleFunc("/json", HandleJsonRequest)
+	products := []Product{}
+	for _, stored := range s.repo.All() {
+		products = append(products, stored.Product)
+	}
+	json.NewEncoder(writer).Encode(products)
 }
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"io"
 	"net/http"
-	"strings"
+	"os"
+	"strconv"
+	"time"
 )
 
 type StringHandler struct {
@@ -84,27 +87,14 @@ func CreatingSimpleHttpServer() {
 	}
 }
 
-func HTTPSRedirect(writer http.ResponseWriter, request *http.Request) {
-	host := strings.Split(request.Host, ":")[0]
-	target := "https://" + host + ":5500" + request.URL.Path
-	if len(request.URL.RawQuery) > 0 {
-		target += "?" + request.URL.RawQuery
-	}
-	http.Redirect(writer, request, target, http.StatusTemporaryRedirect)
-}
+// The certificate, ports and HSTS header come from LoadTLSConfig;
+// see tls.go for the environment variables it reads.
 
 func HandleHTTPRedirectToHTTPS() {
 	http.Handle("/message", StringHandler{"Hello, World"})
 	http.Handle("/favicon.ico", http.NotFoundHandler())
 	http.Handle("/", http.RedirectHandler("/message", http.StatusTemporaryRedirect))
-	go func() {
-		err := http.ListenAndServeTLS(":5500", "certificate.cer",
-			"certificate.key", nil)
-		if err != nil {
-			Printfln("HTTPS Error: %v", err.Error())
-		}
-	}()
-	err := http.ListenAndServe(":5000", http.HandlerFunc(HTTPSRedirect))
+	err := ListenAndServeWithTLS(LoadTLSConfig(), http.DefaultServeMux)
 	if err != nil {
 		Printfln("Error: %v", err.Error())
 	}
@@ -114,7 +104,12 @@ func CreatingStaticFileRoute() {
 	http.Handle("/message", StringHandler{"Hello, World"})
 	http.Handle("/favicon.ico", http.NotFoundHandler())
 	// http.Handle("/", http.RedirectHandler("/message", http.StatusTemporaryRedirect))
-	fsHandler := http.FileServer(http.Dir("./static"))
+	// fsHandler := http.FileServer(http.Dir("./static"))
+	devMode := os.Getenv("HTTPSERVER_DEV") != ""
+	fsHandler := NewStaticHandler(StaticFiles(devMode), StaticOptions{
+		MaxAge: time.Hour,
+		Reload: devMode,
+	})
 	http.Handle("/files/", http.StripPrefix("/files", fsHandler))
 	// go func() {
 	// 	err := http.ListenAndServeTLS(":5500", "certificate.cer",
@@ -129,12 +124,54 @@ func CreatingStaticFileRoute() {
 	}
 }
 
+// Running the product store with its own mux and middleware
+
+func RunningProductServer() {
+	cfg := LoadConfig()
+	repo, err := NewRepository(cfg)
+	if err != nil {
+		Printfln("Error: %v", err.Error())
+		return
+	}
+	server, err := NewServer(cfg, repo)
+	if err != nil {
+		Printfln("Error: %v", err.Error())
+		return
+	}
+	err = server.ListenAndServe()
+	if err != nil {
+		Printfln("Error: %v", err.Error())
+	}
+}
+
+// Running in front of other instances as a load-balancing reverse proxy
+
+func RunningReverseProxy() {
+	cfg, proxyCfg := LoadConfig(), LoadProxyConfig()
+	lb, err := NewLoadBalancer(proxyCfg)
+	if err != nil {
+		Printfln("Error: %v", err.Error())
+		return
+	}
+	go lb.RunHealthChecks(context.Background())
+	go func() {
+		err := http.ListenAndServe(proxyCfg.AdminAddr, NewProxyAdminServer(lb))
+		Printfln("Admin error: %v", err.Error())
+	}()
+	err = http.ListenAndServe(":"+strconv.Itoa(cfg.TLS.HTTPPort), NewProxyServer(lb))
+	if err != nil {
+		Printfln("Error: %v", err.Error())
+	}
+}
+
 func main() {
 	// for _, p := range Products {
 	// 	Printfln("Product: %v, Category: %v, Price: $%.2f", p.Name, p.Category, p.Price)
 	// }
 	// CreatingSimpleHttpServer()
 	// UsingRoutingHandler()
-	// HandleHTTPRedirectToHTTPS() // Add certificate.cer and certificate.key
-	CreatingStaticFileRoute()
+	// HandleHTTPRedirectToHTTPS() // Generates a localhost certificate in ./certs if needed
+	// CreatingStaticFileRoute()
+	// RunningReverseProxy() // Set HTTPSERVER_BACKENDS to the instances to balance
+	RunningProductServer()
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// Middleware wraps a handler to add behaviour before or after it runs.
+
+type Middleware func(http.Handler) http.Handler
+
+// Chain applies the middleware so that the first one listed is the
+// outermost: Chain(h, A, B) handles a request as A(B(h)).
+
+func Chain(handler http.Handler, middleware ...Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// statusRecorder remembers the status code and body size for Logging.
+// Unwrap lets http.ResponseController reach Flush and Hijack on the
+// writer underneath.
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 && status >= 200 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	count, err := r.ResponseWriter.Write(data)
+	r.size += count
+	return count, err
+}
+
+func (r *statusRecorder) Flush() {
+	http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func Logging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: writer}
+		next.ServeHTTP(recorder, request)
+		Printfln("%v %v %v %v %vB %v", request.RemoteAddr, request.Method,
+			request.URL.RequestURI(), recorder.status, recorder.size, time.Since(start))
+	})
+}
+
+// Recovery turns a panicking handler into a 500 response and logs the
+// stack, instead of letting net/http drop the connection.
+
+func Recovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		defer func() {
+			if arg := recover(); arg != nil {
+				if arg == http.ErrAbortHandler {
+					panic(arg)
+				}
+				Printfln("Panic serving %v: %v\n%s", request.URL.Path, arg, debug.Stack())
+				http.Error(writer, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// LimitBody caps the size of the request body before any handler reads it.
+
+func LimitBody(limit int64) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			request.Body = http.MaxBytesReader(writer, request.Body, limit)
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+// gzipWriter compresses the body once the handler has set its headers,
+// leaving responses alone that are already encoded, aren't worth
+// compressing, are streamed event by event, or are partial content, whose
+// byte ranges refer to the uncompressed body. A strong ETag is weakened
+// when the body is compressed, since the bytes sent no longer match it.
+
+type gzipWriter struct {
+	http.ResponseWriter
+	gzip        *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipWriter) WriteHeader(status int) {
+	if status < 200 {
+		// 103 Early Hints and the like come before the real response.
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	header := w.Header()
+	contentType := header.Get("Content-Type")
+	if header.Get("Content-Encoding") == "" && status != http.StatusNoContent &&
+		status != http.StatusNotModified && status != http.StatusPartialContent &&
+		header.Get("Content-Range") == "" && compressibleContentType(contentType) {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		header.Add("Vary", "Accept-Encoding")
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+		w.gzip = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(data))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gzip != nil {
+		return w.gzip.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *gzipWriter) Flush() {
+	if w.gzip != nil {
+		w.gzip.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *gzipWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.gzip != nil {
+		return nil, nil, errors.New("cannot hijack a compressed response")
+	}
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *gzipWriter) close() {
+	if w.gzip != nil {
+		w.gzip.Close()
+	}
+}
+
+// compressibleTypes are worth gzipping on the fly; images and archives
+// are already compressed.
+
+var compressibleTypes = []string{"text/", "application/javascript", "application/json",
+	"image/svg+xml", "application/xml"}
+
+func compressibleContentType(contentType string) bool {
+	if strings.HasPrefix(contentType, "text/event-stream") {
+		return false
+	}
+	for _, prefix := range compressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func Gzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !acceptsEncoding(request.Header.Get("Accept-Encoding"), "gzip") ||
+			request.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		gzipped := &gzipWriter{ResponseWriter: writer}
+		defer gzipped.close()
+		next.ServeHTTP(gzipped, request)
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const gzipTestBody = "<html><body>Some text that is long enough to compress.</body></html>"
+
+func gzipTestHandler(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.Header().Set("ETag", `"strong"`)
+	http.ServeContent(writer, request, "page.html", time.Time{}, strings.NewReader(gzipTestBody))
+}
+
+func TestGzipCompressesAndWeakensETag(t *testing.T) {
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	response := serve(Gzip(http.HandlerFunc(gzipTestHandler)), request)
+	if got := response.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q", got)
+	}
+	if got := response.Header().Get("ETag"); got != `W/"strong"` {
+		t.Errorf("ETag = %q, want the weak form", got)
+	}
+	reader, err := gzip.NewReader(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(reader); string(body) != gzipTestBody {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestGzipLeavesPartialContentAlone(t *testing.T) {
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	request.Header.Set("Range", "bytes=0-9")
+	response := serve(Gzip(http.HandlerFunc(gzipTestHandler)), request)
+	if response.Code != http.StatusPartialContent {
+		t.Fatalf("status = %v", response.Code)
+	}
+	if got := response.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("Content-Encoding = %q on a 206", got)
+	}
+	if got := response.Body.String(); got != gzipTestBody[:10] {
+		t.Errorf("body = %q, want %q", got, gzipTestBody[:10])
+	}
+	if got := response.Header().Get("ETag"); got != `"strong"` {
+		t.Errorf("ETag = %q", got)
+	}
+}
+
+func TestStaticRangeThroughServer(t *testing.T) {
+	server := newTestServer(t, testConfig(t))
+	request := httptest.NewRequest("GET", "/files/index.html", nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	request.Header.Set("Range", "bytes=0-9")
+	response := serve(server, request)
+	if response.Code != http.StatusPartialContent {
+		t.Fatalf("status = %v", response.Code)
+	}
+	if got := response.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("Content-Encoding = %q on a 206", got)
+	}
+	if response.Body.Len() != 10 {
+		t.Errorf("206 has %v bytes, want 10", response.Body.Len())
+	}
+}
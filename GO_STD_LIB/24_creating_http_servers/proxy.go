@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RoundRobin       = "round-robin"
+	LeastConnections = "least-connections"
+)
+
+// ProxyConfig sets up reverse-proxy mode, where this server forwards
+// requests to several instances of itself instead of handling them.
+
+type ProxyConfig struct {
+	Backends            []string
+	Strategy            string
+	HealthCheckPath     string
+	HealthCheckInterval time.Duration
+	BackendTimeout      time.Duration
+	MaxFailures         int
+	EjectionTime        time.Duration
+	AdminAddr           string
+}
+
+// LoadProxyConfig reads HTTPSERVER_BACKENDS (comma separated URLs),
+// HTTPSERVER_BALANCE (round-robin or least-connections),
+// HTTPSERVER_BACKEND_TIMEOUT, HTTPSERVER_HEALTH_INTERVAL and
+// HTTPSERVER_PROXY_ADMIN_ADDR, where the backend report is served. The
+// report stays on the loopback interface unless that is changed.
+
+func LoadProxyConfig() ProxyConfig {
+	cfg := ProxyConfig{
+		Strategy:            RoundRobin,
+		HealthCheckPath:     "/healthz",
+		HealthCheckInterval: envDuration("HTTPSERVER_HEALTH_INTERVAL", 5*time.Second),
+		BackendTimeout:      envDuration("HTTPSERVER_BACKEND_TIMEOUT", 10*time.Second),
+		MaxFailures:         3,
+		EjectionTime:        30 * time.Second,
+		AdminAddr:           "127.0.0.1:8081",
+	}
+	if addr := os.Getenv("HTTPSERVER_PROXY_ADMIN_ADDR"); addr != "" {
+		cfg.AdminAddr = addr
+	}
+	if backends := os.Getenv("HTTPSERVER_BACKENDS"); backends != "" {
+		cfg.Backends = strings.Split(backends, ",")
+	}
+	if strategy := os.Getenv("HTTPSERVER_BALANCE"); strategy != "" {
+		cfg.Strategy = strategy
+	}
+	return cfg
+}
+
+// Backend is one upstream server. It is taken out of rotation when an
+// active health check fails (until one succeeds again) and, passively,
+// for EjectionTime after MaxFailures requests in a row have failed.
+
+type Backend struct {
+	URL   *url.URL
+	proxy *httputil.ReverseProxy
+
+	active   atomic.Int64
+	requests atomic.Int64
+	failures atomic.Int64
+
+	mutex               sync.Mutex
+	healthy             bool
+	consecutiveFailures int
+	ejectedUntil        time.Time
+	lastCheck           time.Time
+	lastError           string
+}
+
+type BackendStatus struct {
+	URL               string
+	Healthy           bool
+	Ejected           bool
+	EjectedUntil      *time.Time `json:",omitempty"`
+	ActiveConnections int64
+	Requests          int64
+	Failures          int64
+	LastCheck         time.Time
+	LastError         string `json:",omitempty"`
+}
+
+func (b *Backend) available(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.healthy && now.After(b.ejectedUntil)
+}
+
+func (b *Backend) status() BackendStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	status := BackendStatus{
+		URL:               b.URL.String(),
+		Healthy:           b.healthy,
+		Ejected:           time.Now().Before(b.ejectedUntil),
+		ActiveConnections: b.active.Load(),
+		Requests:          b.requests.Load(),
+		Failures:          b.failures.Load(),
+		LastCheck:         b.lastCheck,
+		LastError:         b.lastError,
+	}
+	if status.Ejected {
+		until := b.ejectedUntil
+		status.EjectedUntil = &until
+	}
+	return status
+}
+
+func (b *Backend) recordResult(err error, cfg ProxyConfig) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err == nil {
+		b.consecutiveFailures = 0
+		return
+	}
+	b.failures.Add(1)
+	b.lastError = err.Error()
+	b.consecutiveFailures++
+	if b.consecutiveFailures >= cfg.MaxFailures {
+		b.ejectedUntil = time.Now().Add(cfg.EjectionTime)
+		b.consecutiveFailures = 0
+		Printfln("Ejecting backend %v for %v: %v", b.URL, cfg.EjectionTime, err)
+	}
+}
+
+func (b *Backend) recordHealth(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.lastCheck = time.Now()
+	if healthy := err == nil; healthy != b.healthy {
+		Printfln("Backend %v healthy: %v", b.URL, healthy)
+	}
+	b.healthy = err == nil
+	if err != nil {
+		b.lastError = err.Error()
+	}
+}
+
+type LoadBalancer struct {
+	cfg      ProxyConfig
+	backends []*Backend
+	next     atomic.Uint64
+	client   *http.Client
+}
+
+type backendKey struct{}
+
+func NewLoadBalancer(cfg ProxyConfig) (*LoadBalancer, error) {
+	if len(cfg.Backends) == 0 {
+		return nil, errors.New("reverse proxy needs at least one backend")
+	}
+	if cfg.Strategy != RoundRobin && cfg.Strategy != LeastConnections {
+		return nil, fmt.Errorf("unknown balancing strategy %q", cfg.Strategy)
+	}
+	if cfg.HealthCheckInterval <= 0 {
+		return nil, fmt.Errorf("health check interval must be positive, not %v", cfg.HealthCheckInterval)
+	}
+	if cfg.MaxFailures <= 0 {
+		return nil, fmt.Errorf("max failures must be at least 1, not %v", cfg.MaxFailures)
+	}
+	lb := &LoadBalancer{cfg: cfg, client: &http.Client{Timeout: cfg.BackendTimeout}}
+	for _, raw := range cfg.Backends {
+		target, err := url.Parse(strings.TrimSpace(raw))
+		if err != nil || target.Host == "" {
+			return nil, fmt.Errorf("invalid backend URL %q", raw)
+		}
+		backend := &Backend{URL: target, healthy: true}
+		backend.proxy = &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.SetURL(target)
+				r.SetXForwarded()
+			},
+			Transport: &http.Transport{
+				// No ResponseHeaderTimeout: ServeHTTP puts a deadline on
+				// every request that isn't a stream.
+				DialContext:         (&net.Dialer{Timeout: cfg.BackendTimeout}).DialContext,
+				MaxIdleConnsPerHost: 32,
+				IdleConnTimeout:     90 * time.Second,
+			},
+			ModifyResponse: func(response *http.Response) error {
+				if response.StatusCode >= 500 {
+					backend.recordResult(fmt.Errorf("status %v", response.StatusCode), cfg)
+				} else {
+					backend.recordResult(nil, cfg)
+				}
+				return nil
+			},
+			ErrorHandler: func(writer http.ResponseWriter, request *http.Request, err error) {
+				if errors.Is(err, context.Canceled) && request.Context().Err() != nil {
+					// The client went away; that says nothing about the backend.
+					return
+				}
+				backend.recordResult(err, cfg)
+				if errors.Is(err, context.DeadlineExceeded) {
+					http.Error(writer, "Backend timed out", http.StatusGatewayTimeout)
+				} else {
+					http.Error(writer, "Backend unavailable", http.StatusBadGateway)
+				}
+			},
+		}
+		lb.backends = append(lb.backends, backend)
+	}
+	return lb, nil
+}
+
+// choose picks among the backends that are in rotation. Least-connections
+// breaks ties in round-robin order, so idle backends share the load.
+
+func (lb *LoadBalancer) choose() *Backend {
+	now := time.Now()
+	count := len(lb.backends)
+	start := int(lb.next.Add(1) % uint64(count))
+	var chosen *Backend
+	for i := 0; i < count; i++ {
+		backend := lb.backends[(start+i)%count]
+		if !backend.available(now) {
+			continue
+		}
+		if lb.cfg.Strategy == RoundRobin {
+			return backend
+		}
+		if chosen == nil || backend.active.Load() < chosen.active.Load() {
+			chosen = backend
+		}
+	}
+	return chosen
+}
+
+// isStreaming spots event streams and WebSocket upgrades, which are meant
+// to stay open and so are exempt from the backend timeout.
+
+func isStreaming(request *http.Request) bool {
+	return request.Header.Get("Upgrade") != "" ||
+		strings.Contains(request.Header.Get("Accept"), "text/event-stream")
+}
+
+func (lb *LoadBalancer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	backend := lb.choose()
+	if backend == nil {
+		http.Error(writer, "No healthy backends", http.StatusServiceUnavailable)
+		return
+	}
+	backend.active.Add(1)
+	backend.requests.Add(1)
+	defer backend.active.Add(-1)
+	if !isStreaming(request) && lb.cfg.BackendTimeout > 0 {
+		ctx, cancel := context.WithTimeout(request.Context(), lb.cfg.BackendTimeout)
+		defer cancel()
+		request = request.WithContext(ctx)
+	}
+	backend.proxy.ServeHTTP(writer, request)
+}
+
+func (lb *LoadBalancer) checkHealth(ctx context.Context, backend *Backend) {
+	target := backend.URL.JoinPath(lb.cfg.HealthCheckPath)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		backend.recordHealth(err)
+		return
+	}
+	response, err := lb.client.Do(request)
+	if err == nil {
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			err = fmt.Errorf("health check returned %v", response.StatusCode)
+		}
+	}
+	backend.recordHealth(err)
+}
+
+// RunHealthChecks checks every backend straight away and then once per
+// interval until ctx is cancelled.
+
+func (lb *LoadBalancer) RunHealthChecks(ctx context.Context) {
+	ticker := time.NewTicker(lb.cfg.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, backend := range lb.backends {
+			wg.Add(1)
+			go func(backend *Backend) {
+				defer wg.Done()
+				lb.checkHealth(ctx, backend)
+			}(backend)
+		}
+		wg.Wait()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (lb *LoadBalancer) Status() []BackendStatus {
+	statuses := []BackendStatus{}
+	for _, backend := range lb.backends {
+		statuses = append(statuses, backend.status())
+	}
+	return statuses
+}
+
+func (lb *LoadBalancer) HandleAdmin(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, http.StatusOK, map[string]interface{}{
+		"Strategy": lb.cfg.Strategy,
+		"Backends": lb.Status(),
+	})
+}
+
+// NewProxyServer sends every request to the backends.
+
+func NewProxyServer(lb *LoadBalancer) http.Handler {
+	return Chain(lb, Recovery, Logging)
+}
+
+// NewProxyAdminServer serves the health report at /admin/backends. It is
+// meant for its own listener, away from the public port.
+
+func NewProxyAdminServer(lb *LoadBalancer) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/backends", lb.HandleAdmin)
+	return Chain(mux, Recovery)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testBackend answers every request with its name, or with a 500 while
+// failing is set. Requests for /hold block until release is closed or the
+// request is cancelled, after reporting themselves on held.
+
+type testBackend struct {
+	name    string
+	server  *httptest.Server
+	failing atomic.Bool
+	hits    atomic.Int64
+	held    chan string
+	release chan struct{}
+}
+
+func newTestBackend(t *testing.T, name string) *testBackend {
+	t.Helper()
+	backend := &testBackend{name: name, held: make(chan string, 8), release: make(chan struct{})}
+	backend.server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/healthz" {
+			if backend.failing.Load() {
+				http.Error(writer, "down", http.StatusServiceUnavailable)
+			}
+			return
+		}
+		backend.hits.Add(1)
+		if request.URL.Path == "/hold" {
+			backend.held <- name
+			select {
+			case <-backend.release:
+			case <-request.Context().Done():
+				return
+			}
+		}
+		if backend.failing.Load() {
+			http.Error(writer, "broken", http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(writer, name)
+	}))
+	t.Cleanup(backend.server.Close)
+	t.Cleanup(func() { close(backend.release) })
+	return backend
+}
+
+func testProxyConfig(strategy string, backends ...*testBackend) ProxyConfig {
+	cfg := ProxyConfig{
+		Strategy:            strategy,
+		HealthCheckPath:     "/healthz",
+		HealthCheckInterval: time.Hour,
+		BackendTimeout:      time.Second,
+		MaxFailures:         2,
+		EjectionTime:        time.Hour,
+	}
+	for _, backend := range backends {
+		cfg.Backends = append(cfg.Backends, backend.server.URL)
+	}
+	return cfg
+}
+
+func newTestLoadBalancer(t *testing.T, cfg ProxyConfig) *LoadBalancer {
+	t.Helper()
+	lb, err := NewLoadBalancer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lb
+}
+
+func proxyGet(handler http.Handler, path string) *httptest.ResponseRecorder {
+	return serve(handler, httptest.NewRequest("GET", path, nil))
+}
+
+func TestNewLoadBalancerValidatesConfig(t *testing.T) {
+	tests := map[string]ProxyConfig{
+		"no_backends":  {Strategy: RoundRobin},
+		"bad_strategy": {Strategy: "random", Backends: []string{"http://localhost:5000"}},
+		"bad_url":      {Strategy: RoundRobin, Backends: []string{"localhost"}},
+		"zero_interval": {Strategy: RoundRobin, Backends: []string{"http://localhost:5000"},
+			MaxFailures: 1},
+		"negative_interval": {Strategy: RoundRobin, Backends: []string{"http://localhost:5000"},
+			HealthCheckInterval: -time.Second, MaxFailures: 1},
+		"zero_max_failures": {Strategy: RoundRobin, Backends: []string{"http://localhost:5000"},
+			HealthCheckInterval: time.Second},
+	}
+	for name, cfg := range tests {
+		if _, err := NewLoadBalancer(cfg); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	a, b, c := newTestBackend(t, "a"), newTestBackend(t, "b"), newTestBackend(t, "c")
+	lb := newTestLoadBalancer(t, testProxyConfig(RoundRobin, a, b, c))
+	var order string
+	for i := 0; i < 6; i++ {
+		response := proxyGet(lb, "/")
+		if response.Code != http.StatusOK {
+			t.Fatalf("status %d", response.Code)
+		}
+		order += response.Body.String()
+	}
+	if order != "bcabca" {
+		t.Errorf("backends used in order %q, want bcabca", order)
+	}
+}
+
+func TestLeastConnectionsAvoidsBusyBackend(t *testing.T) {
+	a, b := newTestBackend(t, "a"), newTestBackend(t, "b")
+	for _, strategy := range []string{RoundRobin, LeastConnections} {
+		lb := newTestLoadBalancer(t, testProxyConfig(strategy, a, b))
+		held := make(chan *httptest.ResponseRecorder)
+		go func() { held <- proxyGet(lb, "/hold") }()
+		var busy string
+		select {
+		case busy = <-a.held:
+		case busy = <-b.held:
+		case <-time.After(time.Second):
+			t.Fatal("held request never reached a backend")
+		}
+		seen := map[string]int{}
+		for i := 0; i < 4; i++ {
+			seen[proxyGet(lb, "/").Body.String()]++
+		}
+		if strategy == LeastConnections && seen[busy] != 0 {
+			t.Errorf("least-connections sent %d requests to busy backend %v", seen[busy], busy)
+		}
+		if strategy == RoundRobin && seen[busy] != 2 {
+			t.Errorf("round-robin sent %d requests to backend %v, want 2", seen[busy], busy)
+		}
+		for _, backend := range []*testBackend{a, b} {
+			if backend.name == busy {
+				backend.release <- struct{}{}
+			}
+		}
+		if response := <-held; response.Body.String() != busy {
+			t.Errorf("held request answered %q, want %q", response.Body, busy)
+		}
+	}
+}
+
+func TestFailingBackendIsEjectedAndReturns(t *testing.T) {
+	good, bad := newTestBackend(t, "good"), newTestBackend(t, "bad")
+	cfg := testProxyConfig(RoundRobin, good, bad)
+	cfg.EjectionTime = 100 * time.Millisecond
+	lb := newTestLoadBalancer(t, cfg)
+	bad.failing.Store(true)
+
+	for i := 0; i < 4; i++ {
+		proxyGet(lb, "/")
+	}
+	if hits := bad.hits.Load(); hits != int64(cfg.MaxFailures) {
+		t.Fatalf("bad backend got %d requests, want %d", hits, cfg.MaxFailures)
+	}
+	status := lb.Status()[1]
+	if !status.Ejected || status.EjectedUntil == nil || status.Failures != 2 || status.LastError != "status 500" {
+		t.Errorf("status after failures: %+v", status)
+	}
+	for i := 0; i < 4; i++ {
+		if body := proxyGet(lb, "/").Body.String(); body != "good" {
+			t.Fatalf("ejected backend still in rotation: %q", body)
+		}
+	}
+
+	bad.failing.Store(false)
+	time.Sleep(cfg.EjectionTime + 20*time.Millisecond)
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		seen[proxyGet(lb, "/").Body.String()]++
+	}
+	if seen["bad"] != 2 || seen["good"] != 2 {
+		t.Errorf("after ejection expired: %v, want 2 each", seen)
+	}
+	if lb.Status()[1].Ejected {
+		t.Error("backend still reported as ejected")
+	}
+}
+
+func TestHealthCheckTakesBackendOutOfRotation(t *testing.T) {
+	good, bad := newTestBackend(t, "good"), newTestBackend(t, "bad")
+	lb := newTestLoadBalancer(t, testProxyConfig(LeastConnections, good, bad))
+	ctx := context.Background()
+
+	bad.failing.Store(true)
+	lb.checkHealth(ctx, lb.backends[1])
+	if status := lb.Status()[1]; status.Healthy || status.LastError == "" || status.LastCheck.IsZero() {
+		t.Errorf("status after failed check: %+v", status)
+	}
+	for i := 0; i < 4; i++ {
+		if body := proxyGet(lb, "/").Body.String(); body != "good" {
+			t.Fatalf("unhealthy backend still in rotation: %q", body)
+		}
+	}
+
+	bad.failing.Store(false)
+	lb.checkHealth(ctx, lb.backends[1])
+	if !lb.Status()[1].Healthy {
+		t.Error("backend not healthy after a passing check")
+	}
+	good.failing.Store(true)
+	lb.checkHealth(ctx, lb.backends[0])
+	if body := proxyGet(lb, "/").Body.String(); body != "bad" {
+		t.Errorf("recovered backend not used: %q", body)
+	}
+
+	bad.failing.Store(true)
+	lb.checkHealth(ctx, lb.backends[1])
+	if response := proxyGet(lb, "/"); response.Code != http.StatusServiceUnavailable {
+		t.Errorf("no healthy backends: status %d, want 503", response.Code)
+	}
+}
+
+func TestBackendTimeout(t *testing.T) {
+	slow := newTestBackend(t, "slow")
+	cfg := testProxyConfig(RoundRobin, slow)
+	cfg.BackendTimeout = 50 * time.Millisecond
+	lb := newTestLoadBalancer(t, cfg)
+	if response := proxyGet(lb, "/hold"); response.Code != http.StatusGatewayTimeout {
+		t.Errorf("status %d, want 504", response.Code)
+	}
+	if failures := lb.Status()[0].Failures; failures != 1 {
+		t.Errorf("%d failures recorded, want 1", failures)
+	}
+
+	request := httptest.NewRequest("GET", "/hold", nil)
+	request.Header.Set("Accept", "text/event-stream")
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- serve(lb, request) }()
+	<-slow.held
+	time.Sleep(2 * cfg.BackendTimeout)
+	slow.release <- struct{}{}
+	if response := <-done; response.Code != http.StatusOK {
+		t.Errorf("event stream cut off by backend timeout: status %d", response.Code)
+	}
+}
+
+func TestClientCancelIsNotABackendFailure(t *testing.T) {
+	backend := newTestBackend(t, "a")
+	cfg := testProxyConfig(RoundRobin, backend)
+	cfg.MaxFailures = 1
+	lb := newTestLoadBalancer(t, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	request := httptest.NewRequest("GET", "/hold", nil).WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		serve(lb, request)
+		close(done)
+	}()
+	<-backend.held
+	cancel()
+	<-done
+
+	status := lb.Status()[0]
+	if status.Failures != 0 || status.Ejected || status.LastError != "" {
+		t.Errorf("client cancel counted against backend: %+v", status)
+	}
+	if body := proxyGet(lb, "/").Body.String(); body != "a" {
+		t.Errorf("backend out of rotation after client cancel: %q", body)
+	}
+}
+
+func TestAdminBackends(t *testing.T) {
+	a, b := newTestBackend(t, "a"), newTestBackend(t, "b")
+	lb := newTestLoadBalancer(t, testProxyConfig(LeastConnections, a, b))
+	handler := NewProxyServer(lb)
+	for i := 0; i < 3; i++ {
+		proxyGet(handler, "/")
+	}
+	if body := proxyGet(handler, "/admin/backends").Body.String(); strings.Contains(body, "Strategy") {
+		t.Fatalf("backend report served on the public port: %q", body)
+	}
+
+	response := proxyGet(NewProxyAdminServer(lb), "/admin/backends")
+	if response.Code != http.StatusOK || response.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d, content type %q", response.Code, response.Header().Get("Content-Type"))
+	}
+	var report struct {
+		Strategy string
+		Backends []BackendStatus
+	}
+	if err := json.NewDecoder(response.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Strategy != LeastConnections || len(report.Backends) != 2 {
+		t.Fatalf("report: %+v", report)
+	}
+	var requests int64
+	for i, status := range report.Backends {
+		if status.URL != lb.backends[i].URL.String() || !status.Healthy || status.Ejected {
+			t.Errorf("backend %d: %+v", i, status)
+		}
+		requests += status.Requests
+	}
+	if requests != 4 {
+		t.Errorf("%d requests reported, want 4", requests)
+	}
+}
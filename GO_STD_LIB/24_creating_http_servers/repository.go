@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ProductRepository is the only way handlers reach product data. Each
+// product gets an ID when it is added, and IDs are never reused, so an ID
+// keeps naming the same product however many others are added or deleted.
+// Update and Delete return the product as it was before the change.
+
+type ProductRepository interface {
+	All() []StoredProduct
+	Get(id int) (Product, bool)
+	Add(p Product) (int, error)
+	Update(id int, p Product) (Product, error)
+	Delete(id int) (Product, error)
+}
+
+var ErrProductNotFound = errors.New("no product with specified ID")
+
+// StoredProduct is a product together with the ID the repository gave it.
+
+type StoredProduct struct {
+	ID int
+	Product
+}
+
+// productTable is the state shared by the repositories: the products in
+// the order they were added and the next ID to hand out.
+
+type productTable struct {
+	NextID   int
+	Products []StoredProduct
+}
+
+func newProductTable(products []Product) productTable {
+	table := productTable{NextID: 1}
+	for _, p := range products {
+		table.add(p)
+	}
+	return table
+}
+
+func (table productTable) clone() productTable {
+	return productTable{NextID: table.NextID, Products: append([]StoredProduct{}, table.Products...)}
+}
+
+func (table productTable) find(id int) int {
+	for i, stored := range table.Products {
+		if stored.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (table *productTable) add(p Product) int {
+	id := table.NextID
+	table.NextID++
+	table.Products = append(table.Products, StoredProduct{ID: id, Product: p})
+	return id
+}
+
+func (table *productTable) update(id int, p Product) (Product, error) {
+	i := table.find(id)
+	if i == -1 {
+		return Product{}, ErrProductNotFound
+	}
+	previous := table.Products[i].Product
+	table.Products[i].Product = p
+	return previous, nil
+}
+
+func (table *productTable) remove(id int) (Product, error) {
+	i := table.find(id)
+	if i == -1 {
+		return Product{}, ErrProductNotFound
+	}
+	removed := table.Products[i].Product
+	table.Products = append(table.Products[:i], table.Products[i+1:]...)
+	return removed, nil
+}
+
+// MemoryProductRepository guards the product list with a read/write mutex,
+// so the HTML forms, the JSON handler and the REST API can use it at once.
+
+type MemoryProductRepository struct {
+	mutex sync.RWMutex
+	table productTable
+}
+
+func NewMemoryProductRepository(products []Product) *MemoryProductRepository {
+	return &MemoryProductRepository{table: newProductTable(products)}
+}
+
+// All returns a copy, so callers can range over it without holding the lock.
+
+func (repo *MemoryProductRepository) All() []StoredProduct {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	return repo.table.clone().Products
+}
+
+func (repo *MemoryProductRepository) Get(id int) (Product, bool) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	if i := repo.table.find(id); i != -1 {
+		return repo.table.Products[i].Product, true
+	}
+	return Product{}, false
+}
+
+func (repo *MemoryProductRepository) Add(p Product) (int, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	return repo.table.add(p), nil
+}
+
+func (repo *MemoryProductRepository) Update(id int, p Product) (Product, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	return repo.table.update(id, p)
+}
+
+func (repo *MemoryProductRepository) Delete(id int) (Product, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	return repo.table.remove(id)
+}
+
+func (repo *MemoryProductRepository) snapshot() productTable {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	return repo.table.clone()
+}
+
+func (repo *MemoryProductRepository) replace(table productTable) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	repo.table = table
+}
+
+// JSONFileProductRepository keeps the products in memory for reads and
+// writes the whole list to a JSON file after every change. The file is
+// written to a temporary file in the same folder and renamed over the
+// original, so a crash mid-write never leaves a truncated file behind.
+// A change that can't be saved is not applied.
+
+type JSONFileProductRepository struct {
+	path   string
+	writes sync.Mutex
+	*MemoryProductRepository
+}
+
+// NewJSONFileProductRepository loads the file at path, or creates it
+// from seed if it doesn't exist yet. The file holds the products with
+// their IDs and the next ID to use, so IDs survive restarts. A file in the
+// older format, a plain list of products, is numbered from 1 on loading.
+
+func NewJSONFileProductRepository(path string, seed []Product) (*JSONFileProductRepository, error) {
+	repo := &JSONFileProductRepository{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		repo.MemoryProductRepository = NewMemoryProductRepository(seed)
+		return repo, repo.save(repo.snapshot())
+	} else if err != nil {
+		return nil, err
+	}
+	var table productTable
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		products := []Product{}
+		if err := json.Unmarshal(data, &products); err != nil {
+			return nil, err
+		}
+		table = newProductTable(products)
+	} else if err := json.Unmarshal(data, &table); err != nil {
+		return nil, err
+	}
+	for _, stored := range table.Products {
+		if stored.ID >= table.NextID {
+			table.NextID = stored.ID + 1
+		}
+	}
+	repo.MemoryProductRepository = &MemoryProductRepository{table: table}
+	return repo, nil
+}
+
+func (repo *JSONFileProductRepository) save(table productTable) error {
+	data, err := json.MarshalIndent(table, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(repo.path), filepath.Base(repo.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), repo.path)
+}
+
+// change applies fn to a copy of the products, saves the copy and only
+// then makes it visible to readers. Writes are serialised so the file
+// always matches the last change made in memory.
+
+func (repo *JSONFileProductRepository) change(fn func(*productTable) error) error {
+	repo.writes.Lock()
+	defer repo.writes.Unlock()
+	table := repo.snapshot()
+	if err := fn(&table); err != nil {
+		return err
+	}
+	if err := repo.save(table); err != nil {
+		return err
+	}
+	repo.replace(table)
+	return nil
+}
+
+func (repo *JSONFileProductRepository) Add(p Product) (id int, err error) {
+	err = repo.change(func(table *productTable) error {
+		id = table.add(p)
+		return nil
+	})
+	return
+}
+
+func (repo *JSONFileProductRepository) Update(id int, p Product) (previous Product, err error) {
+	err = repo.change(func(table *productTable) (err error) {
+		previous, err = table.update(id, p)
+		return
+	})
+	return
+}
+
+func (repo *JSONFileProductRepository) Delete(id int) (removed Product, err error) {
+	err = repo.change(func(table *productTable) (err error) {
+		removed, err = table.remove(id)
+		return
+	})
+	return
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestIDsSurviveDeletes(t *testing.T) {
+	repos := map[string]ProductRepository{
+		"memory": NewMemoryProductRepository(Products),
+	}
+	file, err := NewJSONFileProductRepository(filepath.Join(t.TempDir(), "products.json"), Products)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos["file"] = file
+	for name, repo := range repos {
+		t.Run(name, func(t *testing.T) {
+			all := repo.All()
+			target := all[4]
+			if _, err := repo.Delete(all[1].ID); err != nil {
+				t.Fatal(err)
+			}
+			if got, ok := repo.Get(target.ID); !ok || got != target.Product {
+				t.Errorf("Get(%v) = %v, %v after an earlier delete; want %v", target.ID, got, ok, target.Product)
+			}
+			if _, ok := repo.Get(all[1].ID); ok {
+				t.Error("deleted product still found")
+			}
+			id, _ := repo.Add(Product{Name: "New", Category: "Test", Price: 1})
+			for _, stored := range all {
+				if stored.ID == id {
+					t.Errorf("ID %v was reused", id)
+				}
+			}
+		})
+	}
+}
+
+func TestJSONFileKeepsIDsAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "products.json")
+	repo, err := NewJSONFileProductRepository(path, Products)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := repo.All()[len(Products)-1].ID
+	repo.Delete(last)
+	reopened, err := NewJSONFileProductRepository(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := reopened.Add(Product{Name: "New"}); id <= last {
+		t.Errorf("new ID %v reuses a deleted one (%v)", id, last)
+	}
+}
+
+func TestJSONFileLoadsOldFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "products.json")
+	data, _ := json.Marshal(Products[:2])
+	os.WriteFile(path, data, 0644)
+	repo, err := NewJSONFileProductRepository(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := repo.All()
+	if len(all) != 2 || all[0].ID == all[1].ID || all[1].Product != Products[1] {
+		t.Errorf("loaded %+v", all)
+	}
+}
+
+func TestAPIUpdateAfterDeleteHitsSameProduct(t *testing.T) {
+	server := newTestServer(t, testConfig(t))
+	all := server.repo.All()
+	target := all[5]
+	if response := serve(server, httptest.NewRequest("DELETE", "/api/products/"+strconv.Itoa(all[2].ID), nil)); response.Code != http.StatusNoContent {
+		t.Fatalf("delete status = %v", response.Code)
+	}
+	body := `{"Name":"Renamed","Category":"Chess","Price":20}`
+	response := serve(server, httptest.NewRequest("PUT", "/api/products/"+strconv.Itoa(target.ID), strings.NewReader(body)))
+	if response.Code != http.StatusOK {
+		t.Fatalf("update status = %v", response.Code)
+	}
+	if p, _ := server.repo.Get(target.ID); p.Name != "Renamed" {
+		t.Errorf("product %v is %v", target.ID, p)
+	}
+	for _, stored := range server.repo.All() {
+		if stored.Name == "Renamed" && stored.ID != target.ID {
+			t.Errorf("update landed on product %v", stored.ID)
+		}
+	}
+}
+
+func TestAPIAcceptsItsOwnOutput(t *testing.T) {
+	server := newTestServer(t, testConfig(t))
+	got := serve(server, httptest.NewRequest("GET", "/api/products/1", nil))
+	if got.Code != http.StatusOK {
+		t.Fatalf("get status = %v", got.Code)
+	}
+	body := got.Body.String()
+	put := serve(server, httptest.NewRequest("PUT", "/api/products/1", strings.NewReader(body)))
+	if put.Code != http.StatusOK || put.Body.String() != body {
+		t.Errorf("put of GET body: %v %s, want 200 %s", put.Code, put.Body, body)
+	}
+
+	moved := serve(server, httptest.NewRequest("PUT", "/api/products/2", strings.NewReader(body)))
+	if moved.Code != http.StatusBadRequest {
+		t.Errorf("put with another product's ID: status %v, want 400", moved.Code)
+	}
+	if p, _ := server.repo.Get(2); p.Name == Products[0].Name {
+		t.Error("mismatched put changed product 2")
+	}
+
+	created := serve(server, httptest.NewRequest("POST", "/api/products", strings.NewReader(body)))
+	if created.Code != http.StatusCreated || created.Header().Get("Location") == "/api/products/1" {
+		t.Errorf("post of GET body: %v %v", created.Code, created.Header().Get("Location"))
+	}
+}
+
+func TestLegacyEditLinkMapsIndexToID(t *testing.T) {
+	server := newTestServer(t, testConfig(t))
+	all := server.repo.All()
+	server.repo.Delete(all[0].ID)
+	response := serve(server, httptest.NewRequest("GET", "/templates/edit.html?index=0", nil))
+	if response.Code != http.StatusOK {
+		t.Fatalf("status = %v", response.Code)
+	}
+	want := `name="id" value="` + strconv.Itoa(all[1].ID) + `"`
+	if !strings.Contains(response.Body.String(), want) {
+		t.Errorf("edit page does not carry %v", want)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config gathers every setting the product server needs. LoadConfig fills
+// it from the environment; tests and other callers can build one directly.
+
+type Config struct {
+	DevMode      bool
+	UseTLS       bool
+	H2C          bool
+	TemplateDir  string
+	UploadDir    string
+	ProductsFile string
+	SessionKey   []byte
+	CORS         CORSOptions
+	Static       StaticOptions
+	TLS          TLSConfig
+}
+
+// LoadConfig reads HTTPSERVER_DEV, HTTPSERVER_TLS, HTTPSERVER_H2C,
+// HTTPSERVER_UPLOADS, HTTPSERVER_PRODUCTS,
+// HTTPSERVER_SESSION_KEY (hex, keeps cookies valid across restarts) and
+// HTTPSERVER_CORS_ORIGINS (comma separated, see CORSOptions for patterns),
+// HTTPSERVER_CORS_CREDENTIALS and HTTPSERVER_CORS_MAX_AGE, plus the TLS
+// settings read by LoadTLSConfig.
+
+func LoadConfig() Config {
+	devMode := os.Getenv("HTTPSERVER_DEV") != ""
+	cfg := Config{
+		DevMode:      devMode,
+		UseTLS:       os.Getenv("HTTPSERVER_TLS") != "",
+		H2C:          os.Getenv("HTTPSERVER_H2C") != "",
+		TemplateDir:  "templates",
+		UploadDir:    "uploads",
+		ProductsFile: os.Getenv("HTTPSERVER_PRODUCTS"),
+		CORS:         DefaultCORSOptions(),
+		Static:       StaticOptions{MaxAge: time.Hour, Reload: devMode},
+		TLS:          LoadTLSConfig(),
+	}
+	if dir := os.Getenv("HTTPSERVER_UPLOADS"); dir != "" {
+		cfg.UploadDir = dir
+	}
+	if key, err := hex.DecodeString(os.Getenv("HTTPSERVER_SESSION_KEY")); err == nil {
+		cfg.SessionKey = key
+	}
+	if origins := os.Getenv("HTTPSERVER_CORS_ORIGINS"); origins != "" {
+		cfg.CORS.AllowedOrigins = strings.Split(origins, ",")
+	}
+	cfg.CORS.AllowCredentials = os.Getenv("HTTPSERVER_CORS_CREDENTIALS") != ""
+	cfg.CORS.MaxAge = envDuration("HTTPSERVER_CORS_MAX_AGE", cfg.CORS.MaxAge)
+	return cfg
+}
+
+// NewRepository keeps products in cfg.ProductsFile when one is set and
+// in memory otherwise, seeded from the Products list either way.
+
+func NewRepository(cfg Config) (ProductRepository, error) {
+	if cfg.ProductsFile != "" {
+		return NewJSONFileProductRepository(cfg.ProductsFile, Products)
+	}
+	return NewMemoryProductRepository(Products), nil
+}
+
+const (
+	eventHistorySize = 100
+	eventBufferSize  = 16
+)
+
+// Server is the product store application. It owns its mux, so creating
+// one has no effect on http.DefaultServeMux or on any other Server.
+// Changes made through the server's repository are published to its
+// event broker.
+
+type Server struct {
+	cfg       Config
+	repo      ProductRepository
+	templates *TemplateCache
+	sessions  *SessionManager
+	events    *EventBroker
+	cors      *corsPolicy
+	handler   http.Handler
+}
+
+func NewServer(cfg Config, repo ProductRepository) (*Server, error) {
+	cors, err := newCORSPolicy(cfg.CORS)
+	if err != nil {
+		return nil, err
+	}
+	templates, err := NewTemplateCache(cfg.TemplateDir, cfg.DevMode)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cfg.UploadDir, 0755); err != nil {
+		return nil, err
+	}
+	key := cfg.SessionKey
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	events := NewEventBroker(eventHistorySize, eventBufferSize)
+	s := &Server{
+		cfg:       cfg,
+		repo:      NewObservableRepository(repo, events),
+		templates: templates,
+		sessions:  NewSessionManager(key, sessionLifetime),
+		events:    events,
+		cors:      cors,
+	}
+	s.handler = Chain(s.routes(),
+		Recovery,
+		Logging,
+		cors.middleware,
+		Gzip,
+	)
+	return s, nil
+}
+
+func (s *Server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /json", s.handleJSON)
+
+	mux.HandleFunc("GET /api/products", s.listProducts)
+	mux.HandleFunc("POST /api/products", s.createProduct)
+	mux.HandleFunc("GET /api/products/{id}", s.getProduct)
+	mux.HandleFunc("PUT /api/products/{id}", s.updateProduct)
+	mux.HandleFunc("DELETE /api/products/{id}", s.deleteProduct)
+
+	mux.HandleFunc("GET /events", s.handleEvents)
+	mux.HandleFunc("GET /ws", s.handleWebSocket)
+
+	mux.Handle("GET /templates", http.RedirectHandler("/templates/", http.StatusMovedPermanently))
+	mux.HandleFunc("GET /templates/{$}", s.handleTemplatePage)
+	mux.HandleFunc("GET /templates/{name}", s.handleTemplatePage)
+	mux.HandleFunc("GET /templates/edit.html", s.handleEditPage)
+
+	formLimit, uploadLimit := LimitBody(maxFormSize), LimitBody(maxUploadSize)
+	mux.Handle("POST /forms/edit", Chain(http.HandlerFunc(s.processEditForm), formLimit, s.RequireCSRF))
+	mux.Handle("POST /forms/delete", Chain(http.HandlerFunc(s.processDeleteForm), formLimit, s.RequireCSRF))
+	mux.HandleFunc("GET /forms/upload", s.handleUploads)
+	mux.Handle("POST /forms/upload", Chain(http.HandlerFunc(s.handleUploads), uploadLimit, s.RequireCSRF))
+
+	mux.HandleFunc("GET /files/uploads/{name}", s.serveUpload)
+	mux.Handle("GET /files/uploads/", http.NotFoundHandler())
+	mux.Handle("GET /files/", http.StripPrefix("/files",
+		NewStaticHandler(StaticFiles(s.cfg.DevMode), s.cfg.Static)))
+
+	mux.HandleFunc("GET /healthz", func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("ok"))
+	})
+	mux.Handle("/favicon.ico", http.NotFoundHandler())
+	mux.Handle("GET /{$}", http.RedirectHandler("/templates/", http.StatusTemporaryRedirect))
+	return mux
+}
+
+func (s *Server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	s.handler.ServeHTTP(writer, request)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testConfig(t *testing.T) Config {
+	return Config{
+		TemplateDir: "templates",
+		UploadDir:   t.TempDir(),
+		SessionKey:  []byte("test session key"),
+		CORS:        DefaultCORSOptions(),
+	}
+}
+
+func newTestServer(t *testing.T, cfg Config) *Server {
+	t.Helper()
+	server, err := NewServer(cfg, NewMemoryProductRepository(Products))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func serve(handler http.Handler, request *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
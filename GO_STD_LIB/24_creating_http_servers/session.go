@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookieName = "httpserver_session"
+	sessionLifetime   = 12 * time.Hour
+	sessionSweepEvery = 10 * time.Minute
+	maxSessions       = 10000
+	csrfFieldName     = "csrf_token"
+	csrfHeaderName    = "X-CSRF-Token"
+	maxFormSize       = 1 << 20
+)
+
+// Session is the server-side state for one browser. Only the session ID
+// travels in the cookie, signed so it can't be forged or guessed.
+
+type Session struct {
+	ID        string
+	CSRFToken string
+	expires   time.Time
+	mutex     sync.Mutex
+	flashes   []string
+}
+
+// AddFlash queues a message to be shown on the next page that is rendered.
+
+func (s *Session) AddFlash(message string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.flashes = append(s.flashes, message)
+}
+
+// Flashes returns the queued messages and clears them, so each is shown once.
+
+func (s *Session) Flashes() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	flashes := s.flashes
+	s.flashes = nil
+	return flashes
+}
+
+var ErrTooManySessions = errors.New("too many sessions")
+
+// SessionManager keeps sessions in memory. Sessions are only created when
+// there is something to store in them, at most maxSessions are kept, and
+// expired ones are removed by RunSweeper rather than on each request.
+
+type SessionManager struct {
+	key         []byte
+	lifetime    time.Duration
+	maxSessions int
+	mutex       sync.Mutex
+	sessions    map[string]*Session
+}
+
+func NewSessionManager(key []byte, lifetime time.Duration) *SessionManager {
+	return &SessionManager{
+		key:         key,
+		lifetime:    lifetime,
+		maxSessions: maxSessions,
+		sessions:    map[string]*Session{},
+	}
+}
+
+func (m *SessionManager) Count() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.sessions)
+}
+
+func randomToken() string {
+	buffer := make([]byte, 32)
+	if _, err := rand.Read(buffer); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buffer)
+}
+
+func (m *SessionManager) sign(id string) string {
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (m *SessionManager) verify(value string) (string, bool) {
+	id, signature, found := strings.Cut(value, ".")
+	if !found {
+		return "", false
+	}
+	expected := m.sign(id)
+	return id, hmac.Equal([]byte(expected[len(id)+1:]), []byte(signature))
+}
+
+// Get returns the live session named by the request cookie, if there is one.
+
+func (m *SessionManager) Get(request *http.Request) (*Session, bool) {
+	cookie, err := request.Cookie(sessionCookieName)
+	if err != nil {
+		return nil, false
+	}
+	id, ok := m.verify(cookie.Value)
+	if !ok {
+		return nil, false
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	session, ok := m.sessions[id]
+	if !ok || time.Now().After(session.expires) {
+		delete(m.sessions, id)
+		return nil, false
+	}
+	session.expires = time.Now().Add(m.lifetime)
+	return session, true
+}
+
+// Start returns the request's session, creating one and setting the cookie
+// when the browser doesn't have a valid session yet. It fails with
+// ErrTooManySessions rather than grow past the limit.
+
+func (m *SessionManager) Start(writer http.ResponseWriter, request *http.Request) (*Session, error) {
+	if session, ok := m.Get(request); ok {
+		return session, nil
+	}
+	session := &Session{
+		ID:        randomToken(),
+		CSRFToken: randomToken(),
+		expires:   time.Now().Add(m.lifetime),
+	}
+	m.mutex.Lock()
+	if len(m.sessions) >= m.maxSessions {
+		m.mutex.Unlock()
+		return nil, ErrTooManySessions
+	}
+	m.sessions[session.ID] = session
+	m.mutex.Unlock()
+	http.SetCookie(writer, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    m.sign(session.ID),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   request.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return session, nil
+}
+
+func (m *SessionManager) removeExpired() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	for id, session := range m.sessions {
+		if now.After(session.expires) {
+			delete(m.sessions, id)
+		}
+	}
+}
+
+// RunSweeper removes expired sessions once per interval until ctx is
+// cancelled.
+
+func (m *SessionManager) RunSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.removeExpired()
+		}
+	}
+}
+
+// parseRequestForm reads url-encoded and multipart bodies alike, so the
+// CSRF token can be found whichever encoding the form uses.
+
+func parseRequestForm(request *http.Request) error {
+	if strings.HasPrefix(request.Header.Get("Content-Type"), "multipart/form-data") {
+		return request.ParseMultipartForm(maxUploadMemory)
+	}
+	return request.ParseForm()
+}
+
+// RequireCSRF rejects any POST whose token, sent as a form field or a
+// header, doesn't match the token stored in the caller's session.
+
+func (s *Server) RequireCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method == http.MethodPost {
+			if err := parseRequestForm(request); err != nil {
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					http.Error(writer, "Request body too large", http.StatusRequestEntityTooLarge)
+				} else {
+					http.Error(writer, err.Error(), http.StatusBadRequest)
+				}
+				return
+			}
+			token := request.Header.Get(csrfHeaderName)
+			if token == "" {
+				token = request.PostFormValue(csrfFieldName)
+			}
+			session, ok := s.sessions.Get(request)
+			if !ok || token == "" ||
+				subtle.ConstantTimeCompare([]byte(token), []byte(session.CSRFToken)) != 1 {
+				http.Error(writer, "Invalid or missing CSRF token", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// newContext fills in the values every template needs: any pending
+// flashes and, for pages with forms, the CSRF token. A session is only
+// started when a template asks for the token, so pages without forms
+// don't create one for every visitor.
+
+func (s *Server) newContext(writer http.ResponseWriter, request *http.Request, data interface{}) Context {
+	ctx := Context{Request: request, Data: data}
+	session, ok := s.sessions.Get(request)
+	if ok {
+		ctx.Flashes = session.Flashes()
+	}
+	ctx.csrfToken = func() string {
+		if session == nil {
+			var err error
+			if session, err = s.sessions.Start(writer, request); err != nil {
+				return ""
+			}
+		}
+		return session.CSRFToken
+	}
+	return ctx
+}
+
+// addFlash queues a message for the next page. When no session can be
+// started the message is dropped; it's only a notice.
+
+func (s *Server) addFlash(writer http.ResponseWriter, request *http.Request, message string) {
+	if session, err := s.sessions.Start(writer, request); err == nil {
+		session.AddFlash(message)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var csrfInput = regexp.MustCompile(`name="csrf_token" value="([^"]*)"`)
+
+func sessionCookie(response *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range response.Result().Cookies() {
+		if cookie.Name == sessionCookieName {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func csrfTokenIn(t *testing.T, response *httptest.ResponseRecorder) string {
+	t.Helper()
+	match := csrfInput.FindStringSubmatch(response.Body.String())
+	if match == nil {
+		t.Fatalf("no csrf_token field in %q", response.Body)
+	}
+	return match[1]
+}
+
+func TestPagesWithoutFormsDontStartSessions(t *testing.T) {
+	server := newTestServer(t, testConfig(t))
+	for i := 0; i < 1000; i++ {
+		response := serve(server, httptest.NewRequest("GET", "/templates/", nil))
+		if response.Code != http.StatusOK {
+			t.Fatalf("status %d", response.Code)
+		}
+		if cookie := sessionCookie(response); cookie != nil {
+			t.Fatalf("store page set a session cookie")
+		}
+	}
+	if count := server.sessions.Count(); count != 0 {
+		t.Errorf("%d sessions stored, want 0", count)
+	}
+}
+
+func TestFormPageStartsOneSession(t *testing.T) {
+	server := newTestServer(t, testConfig(t))
+	first := serve(server, httptest.NewRequest("GET", "/templates/upload.html", nil))
+	cookie := sessionCookie(first)
+	token := csrfTokenIn(t, first)
+	if cookie == nil || token == "" {
+		t.Fatalf("form page: cookie %v, token %q", cookie, token)
+	}
+
+	request := httptest.NewRequest("GET", "/templates/upload.html", nil)
+	request.AddCookie(cookie)
+	second := serve(server, request)
+	if sessionCookie(second) != nil {
+		t.Error("existing session was replaced")
+	}
+	if got := csrfTokenIn(t, second); got != token {
+		t.Errorf("token changed from %q to %q", token, got)
+	}
+	if count := server.sessions.Count(); count != 1 {
+		t.Errorf("%d sessions stored, want 1", count)
+	}
+}
+
+func TestSessionLimit(t *testing.T) {
+	server := newTestServer(t, testConfig(t))
+	server.sessions.maxSessions = 2
+	for i := 0; i < 2; i++ {
+		serve(server, httptest.NewRequest("GET", "/templates/upload.html", nil))
+	}
+	response := serve(server, httptest.NewRequest("GET", "/templates/upload.html", nil))
+	if response.Code != http.StatusOK {
+		t.Errorf("status %d, want the page without a token", response.Code)
+	}
+	if sessionCookie(response) != nil || csrfTokenIn(t, response) != "" {
+		t.Error("session started past the limit")
+	}
+	if count := server.sessions.Count(); count != 2 {
+		t.Errorf("%d sessions stored, want 2", count)
+	}
+}
+
+func TestSweeperRemovesExpiredSessions(t *testing.T) {
+	manager := NewSessionManager([]byte("key"), 10*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if _, err := manager.Start(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go manager.RunSweeper(ctx, 5*time.Millisecond)
+	deadline := time.Now().Add(2 * time.Second)
+	for manager.Count() != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if count := manager.Count(); count != 0 {
+		t.Errorf("%d expired sessions left", count)
+	}
+}
+
+func TestCSRFAndFlashRoundTrip(t *testing.T) {
+	server := newTestServer(t, testConfig(t))
+	page := serve(server, httptest.NewRequest("GET", "/templates/edit.html?id=1", nil))
+	cookie := sessionCookie(page)
+	token := csrfTokenIn(t, page)
+
+	post := func(token string) *httptest.ResponseRecorder {
+		form := url.Values{"id": {"1"}, "name": {"Kayak"}, "category": {"Watersports"},
+			"price": {"300"}, csrfFieldName: {token}}
+		request := httptest.NewRequest("POST", "/forms/edit", strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request.AddCookie(cookie)
+		return serve(server, request)
+	}
+	if response := post("wrong"); response.Code != http.StatusForbidden {
+		t.Errorf("bad token: status %d, want 403", response.Code)
+	}
+	if response := post(token); response.Code != http.StatusSeeOther {
+		t.Fatalf("status %d, want 303", response.Code)
+	}
+
+	request := httptest.NewRequest("GET", "/templates/", nil)
+	request.AddCookie(cookie)
+	if body := serve(server, request).Body.String(); !strings.Contains(body, "Product saved") {
+		t.Error("flash not shown after redirect")
+	}
+	request = httptest.NewRequest("GET", "/templates/", nil)
+	request.AddCookie(cookie)
+	if body := serve(server, request).Body.String(); strings.Contains(body, "Product saved") {
+		t.Error("flash shown twice")
+	}
+}
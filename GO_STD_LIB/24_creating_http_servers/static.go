@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed static
+var embeddedStatic embed.FS
+
+// StaticFiles returns the embedded copy of the static folder, so the binary
+// can run from anywhere. In dev mode the folder is read from disk instead,
+// so edits show up without rebuilding.
+
+func StaticFiles(devMode bool) fs.FS {
+	if devMode {
+		return os.DirFS("static")
+	}
+	files, err := fs.Sub(embeddedStatic, "static")
+	if err != nil {
+		panic(err)
+	}
+	return files
+}
+
+type StaticOptions struct {
+	// MaxAge is sent in Cache-Control for everything except html pages,
+	// which are always revalidated so a deploy is picked up at once.
+	MaxAge time.Duration
+	// SPAFallback serves index.html for GET requests to paths without a
+	// file extension that don't match a file, so client-side routes work.
+	SPAFallback bool
+	// Reload reads files on every request instead of keeping them in
+	// memory, for use with a folder on disk in dev mode.
+	Reload bool
+}
+
+// staticEntry is one representation of a file, either as stored or
+// compressed, with a strong ETag computed from its exact bytes. A missing
+// entry records that the representation doesn't exist, so the lookup
+// isn't repeated on every request.
+
+type staticEntry struct {
+	content  []byte
+	etag     string
+	encoding string
+	missing  bool
+}
+
+type StaticHandler struct {
+	files   fs.FS
+	options StaticOptions
+	mutex   sync.Mutex
+	cache   map[string]staticEntry
+}
+
+func NewStaticHandler(files fs.FS, options StaticOptions) *StaticHandler {
+	return &StaticHandler{files: files, options: options, cache: map[string]staticEntry{}}
+}
+
+const minCompressSize = 1024
+
+// acceptsEncoding reports whether the Accept-Encoding header allows enc,
+// treating a q value of 0 as a refusal.
+
+func acceptsEncoding(header, enc string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), enc) && strings.TrimSpace(name) != "*" {
+			continue
+		}
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if value, err := strconv.ParseFloat(q, 64); err == nil && value == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func newStaticEntry(content []byte, encoding string) staticEntry {
+	sum := sha256.Sum256(content)
+	return staticEntry{
+		content:  content,
+		etag:     `"` + hex.EncodeToString(sum[:16]) + `"`,
+		encoding: encoding,
+	}
+}
+
+// load returns the cached representation of name in the given encoding,
+// reading a precompressed .gz or .br sibling when one exists and gzipping
+// compressible files itself otherwise. An empty encoding is the file as
+// stored. Files are read without holding the lock; if two requests miss
+// at once both read the file and the second result is kept.
+
+func (h *StaticHandler) load(name, encoding string) (staticEntry, error) {
+	key := encoding + ":" + name
+	h.mutex.Lock()
+	entry, found := h.cache[key]
+	h.mutex.Unlock()
+	if !found {
+		var err error
+		if entry, err = h.read(name, encoding); errors.Is(err, fs.ErrNotExist) {
+			entry = staticEntry{missing: true}
+		} else if err != nil {
+			return entry, err
+		}
+		if !h.options.Reload {
+			h.mutex.Lock()
+			h.cache[key] = entry
+			h.mutex.Unlock()
+		}
+	}
+	if entry.missing {
+		return entry, fs.ErrNotExist
+	}
+	return entry, nil
+}
+
+func (h *StaticHandler) read(name, encoding string) (staticEntry, error) {
+	var entry staticEntry
+	switch encoding {
+	case "":
+		content, err := fs.ReadFile(h.files, name)
+		if err != nil {
+			return entry, err
+		}
+		entry = newStaticEntry(content, "")
+	case "br":
+		content, err := fs.ReadFile(h.files, name+".br")
+		if err != nil {
+			return entry, err
+		}
+		entry = newStaticEntry(content, "br")
+	case "gzip":
+		if content, err := fs.ReadFile(h.files, name+".gz"); err == nil {
+			entry = newStaticEntry(content, "gzip")
+			break
+		}
+		if !compressibleContentType(mime.TypeByExtension(path.Ext(name))) {
+			return entry, fs.ErrNotExist
+		}
+		content, err := fs.ReadFile(h.files, name)
+		if err != nil {
+			return entry, err
+		}
+		if len(content) < minCompressSize {
+			return entry, fs.ErrNotExist
+		}
+		var buffer bytes.Buffer
+		writer, _ := gzip.NewWriterLevel(&buffer, gzip.BestCompression)
+		writer.Write(content)
+		writer.Close()
+		entry = newStaticEntry(buffer.Bytes(), "gzip")
+	}
+	return entry, nil
+}
+
+// resolve maps a URL path to a file name, serving index.html for folders
+// that have one and refusing everything else that isn't a regular file,
+// so folder contents are never listed.
+
+func (h *StaticHandler) resolve(urlPath string) (string, bool) {
+	name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if name == "" {
+		name = "."
+	}
+	info, err := fs.Stat(h.files, name)
+	if err == nil && info.IsDir() {
+		name = path.Join(name, "index.html")
+		info, err = fs.Stat(h.files, name)
+	}
+	if err != nil || !info.Mode().IsRegular() {
+		return name, false
+	}
+	return name, true
+}
+
+func (h *StaticHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		writer.Header().Set("Allow", "GET, HEAD")
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, found := h.resolve(request.URL.Path)
+	if !found && h.options.SPAFallback && path.Ext(request.URL.Path) == "" {
+		name, found = h.resolve("index.html")
+	}
+	if !found {
+		http.NotFound(writer, request)
+		return
+	}
+
+	header := writer.Header()
+	header.Add("Vary", "Accept-Encoding")
+	if path.Ext(name) == ".html" {
+		header.Set("Cache-Control", "no-cache")
+	} else {
+		header.Set("Cache-Control", "public, max-age="+strconv.Itoa(int(h.options.MaxAge.Seconds())))
+	}
+
+	acceptEncoding := request.Header.Get("Accept-Encoding")
+	var entry staticEntry
+	var err error = fs.ErrNotExist
+	for _, encoding := range []string{"br", "gzip"} {
+		if acceptsEncoding(acceptEncoding, encoding) {
+			if entry, err = h.load(name, encoding); err == nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		if entry, err = h.load(name, ""); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				http.NotFound(writer, request)
+			} else {
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+	if entry.encoding != "" {
+		header.Set("Content-Encoding", entry.encoding)
+	}
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	header.Set("ETag", entry.etag)
+	// ServeContent answers If-None-Match and Range requests from the ETag.
+	http.ServeContent(writer, request, name, time.Time{}, bytes.NewReader(entry.content))
+}
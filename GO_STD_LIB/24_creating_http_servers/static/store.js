@@ -0,0 +1,44 @@
+// Keeps the product table on store.html up to date. Every change pushed
+// on /events causes the list to be fetched again from the API.
+
+(function () {
+    var tbody = document.getElementById("products");
+    if (!tbody || !window.EventSource) {
+        return;
+    }
+
+    function cell(text) {
+        var td = document.createElement("td");
+        td.textContent = text;
+        return td;
+    }
+
+    function render(products) {
+        var rows = products.map(function (p) {
+            var tr = document.createElement("tr");
+            tr.appendChild(cell(p.ID));
+            tr.appendChild(cell(p.Name));
+            tr.appendChild(cell(p.Category));
+            tr.appendChild(cell("$" + p.Price.toFixed(2)));
+            var edit = document.createElement("a");
+            edit.href = "/templates/edit.html?id=" + p.ID;
+            edit.className = "btn btn-sm btn-warning";
+            edit.textContent = "Edit";
+            var td = document.createElement("td");
+            td.appendChild(edit);
+            tr.appendChild(td);
+            return tr;
+        });
+        tbody.replaceChildren.apply(tbody, rows);
+    }
+
+    function reload() {
+        fetch("/api/products")
+            .then(function (response) { return response.json(); })
+            .then(render);
+    }
+
+    var source = new EventSource("/events");
+    source.addEventListener("product", reload);
+    source.addEventListener("reset", reload);
+})();
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// countingFS counts the files opened through it, by name. Stat is passed
+// straight through, so only reads are counted.
+
+type countingFS struct {
+	fs.FS
+	mutex sync.Mutex
+	opens map[string]int
+}
+
+func (c *countingFS) Open(name string) (fs.File, error) {
+	c.mutex.Lock()
+	c.opens[name]++
+	c.mutex.Unlock()
+	return c.FS.Open(name)
+}
+
+func (c *countingFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(c.FS, name)
+}
+
+func (c *countingFS) count(name string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.opens[name]
+}
+
+var bigCSS = strings.Repeat("body { margin: 0; }\n", 100)
+
+func testStaticFiles() *countingFS {
+	return &countingFS{opens: map[string]int{}, FS: fstest.MapFS{
+		"index.html":      {Data: []byte("<h1>home</h1>")},
+		"small.css":       {Data: []byte("p {}")},
+		"big.css":         {Data: []byte(bigCSS)},
+		"logo.png":        {Data: bytes.Repeat([]byte{0x89}, 4096)},
+		"app.js":          {Data: []byte("plain js")},
+		"app.js.br":       {Data: []byte("brotli js")},
+		"docs/index.html": {Data: []byte("docs")},
+		"empty/.keep":     {Data: nil},
+	}}
+}
+
+func staticGet(handler http.Handler, path, acceptEncoding string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("GET", path, nil)
+	if acceptEncoding != "" {
+		request.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	return serve(handler, request)
+}
+
+func TestStaticEncodings(t *testing.T) {
+	handler := NewStaticHandler(testStaticFiles(), StaticOptions{MaxAge: time.Hour})
+	tests := []struct {
+		path, accept, encoding, body string
+	}{
+		{"/app.js", "gzip, br", "br", "brotli js"},
+		{"/app.js", "gzip", "", "plain js"},
+		{"/app.js", "br;q=0, gzip", "", "plain js"},
+		{"/small.css", "gzip", "", "p {}"},
+		{"/logo.png", "gzip", "", strings.Repeat("\x89", 4096)},
+		{"/big.css", "", "", bigCSS},
+	}
+	for _, test := range tests {
+		response := staticGet(handler, test.path, test.accept)
+		if response.Code != http.StatusOK {
+			t.Errorf("%v %q: status %d", test.path, test.accept, response.Code)
+			continue
+		}
+		if got := response.Header().Get("Content-Encoding"); got != test.encoding {
+			t.Errorf("%v %q: Content-Encoding %q, want %q", test.path, test.accept, got, test.encoding)
+		}
+		if response.Body.String() != test.body {
+			t.Errorf("%v %q: body %.40q", test.path, test.accept, response.Body)
+		}
+	}
+
+	response := staticGet(handler, "/big.css", "gzip")
+	if response.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("big compressible file not gzipped")
+	}
+	reader, err := gzip.NewReader(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(reader); string(body) != bigCSS {
+		t.Error("gzipped body does not match the file")
+	}
+	if response.Header().Get("Content-Type") != "text/css; charset=utf-8" ||
+		response.Header().Get("Cache-Control") != "public, max-age=3600" {
+		t.Errorf("headers %v", response.Header())
+	}
+}
+
+func TestStaticCachesMisses(t *testing.T) {
+	files := testStaticFiles()
+	handler := NewStaticHandler(files, StaticOptions{})
+	for i := 0; i < 5; i++ {
+		for _, path := range []string{"/small.css", "/logo.png"} {
+			if response := staticGet(handler, path, "br, gzip"); response.Code != http.StatusOK {
+				t.Fatalf("%v: status %d", path, response.Code)
+			}
+		}
+	}
+	// small.css is read a second time to find it's too small to gzip;
+	// logo.png isn't, its type already rules gzip out.
+	want := map[string]int{"small.css": 2, "small.css.br": 1, "small.css.gz": 1,
+		"logo.png": 1, "logo.png.br": 1, "logo.png.gz": 1}
+	for name, count := range want {
+		if opens := files.count(name); opens != count {
+			t.Errorf("%v opened %d times, want %d", name, opens, count)
+		}
+	}
+
+	reload := testStaticFiles()
+	handler = NewStaticHandler(reload, StaticOptions{Reload: true})
+	staticGet(handler, "/small.css", "br")
+	staticGet(handler, "/small.css", "br")
+	if opens := reload.count("small.css.br"); opens != 2 {
+		t.Errorf("reload mode: small.css.br opened %d times, want 2", opens)
+	}
+}
+
+func TestStaticConditionalAndRange(t *testing.T) {
+	handler := NewStaticHandler(testStaticFiles(), StaticOptions{})
+	first := staticGet(handler, "/big.css", "")
+	etag := first.Header().Get("ETag")
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		t.Fatalf("ETag %q, want a strong ETag", etag)
+	}
+	request := httptest.NewRequest("GET", "/big.css", nil)
+	request.Header.Set("If-None-Match", etag)
+	if response := serve(handler, request); response.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: status %d, want 304", response.Code)
+	}
+	request = httptest.NewRequest("GET", "/big.css", nil)
+	request.Header.Set("Range", "bytes=0-3")
+	if response := serve(handler, request); response.Code != http.StatusPartialContent ||
+		response.Body.String() != "body" {
+		t.Errorf("Range: %d %q", response.Code, response.Body)
+	}
+	if gzipped := staticGet(handler, "/big.css", "gzip").Header().Get("ETag"); gzipped == etag {
+		t.Error("gzipped and plain representations share an ETag")
+	}
+}
+
+func TestStaticPaths(t *testing.T) {
+	handler := NewStaticHandler(testStaticFiles(), StaticOptions{})
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/", http.StatusOK, "<h1>home</h1>"},
+		{"/docs/", http.StatusOK, "docs"},
+		{"/empty/", http.StatusNotFound, ""},
+		{"/missing.css", http.StatusNotFound, ""},
+		{"/../index.html", http.StatusOK, "<h1>home</h1>"},
+		{"/products/42", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		response := staticGet(handler, test.path, "")
+		if response.Code != test.status {
+			t.Errorf("%v: status %d, want %d", test.path, response.Code, test.status)
+		}
+		if test.body != "" && response.Body.String() != test.body {
+			t.Errorf("%v: body %q", test.path, response.Body)
+		}
+	}
+	if cc := staticGet(handler, "/", "").Header().Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("html Cache-Control %q, want no-cache", cc)
+	}
+
+	spa := NewStaticHandler(testStaticFiles(), StaticOptions{SPAFallback: true})
+	if body := staticGet(spa, "/products/42", "").Body.String(); body != "<h1>home</h1>" {
+		t.Errorf("SPA fallback served %q", body)
+	}
+	if response := staticGet(spa, "/missing.css", ""); response.Code != http.StatusNotFound {
+		t.Errorf("SPA fallback for a file: status %d, want 404", response.Code)
+	}
+
+	post := serve(handler, httptest.NewRequest("POST", "/index.html", nil))
+	if post.Code != http.StatusMethodNotAllowed || post.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("POST: %d, Allow %q", post.Code, post.Header().Get("Allow"))
+	}
+}
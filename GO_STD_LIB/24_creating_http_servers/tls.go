@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TLSConfig describes how the server listens for HTTP and HTTPS. When
+// CertFile and KeyFile are empty a local CA and a localhost certificate
+// are generated into CertDir and reused on later runs.
+
+type TLSConfig struct {
+	HTTPPort, HTTPSPort   int
+	CertFile, KeyFile     string
+	CertDir               string
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+}
+
+func envInt(name string, fallback int) int {
+	if value, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return value
+	}
+	return fallback
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(name)); err == nil {
+		return value
+	}
+	return fallback
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// LoadTLSConfig reads the HTTPSERVER_HTTP_PORT, HTTPSERVER_HTTPS_PORT,
+// HTTPSERVER_CERT, HTTPSERVER_KEY, HTTPSERVER_CERT_DIR and
+// HTTPSERVER_HSTS_MAX_AGE environment variables. The certificate.cer and
+// certificate.key files used earlier in the chapter are still picked up
+// when they are present.
+
+func LoadTLSConfig() TLSConfig {
+	cfg := TLSConfig{
+		HTTPPort:   envInt("HTTPSERVER_HTTP_PORT", 5000),
+		HTTPSPort:  envInt("HTTPSERVER_HTTPS_PORT", 5500),
+		CertFile:   os.Getenv("HTTPSERVER_CERT"),
+		KeyFile:    os.Getenv("HTTPSERVER_KEY"),
+		CertDir:    "certs",
+		HSTSMaxAge: envDuration("HTTPSERVER_HSTS_MAX_AGE", 0),
+	}
+	if dir := os.Getenv("HTTPSERVER_CERT_DIR"); dir != "" {
+		cfg.CertDir = dir
+	}
+	if cfg.CertFile == "" && fileExists("certificate.cer") && fileExists("certificate.key") {
+		cfg.CertFile, cfg.KeyFile = "certificate.cer", "certificate.key"
+	}
+	return cfg
+}
+
+// ServerTLSConfig returns a tls.Config that reloads the certificate from
+// disk when it changes, generating a development certificate first if
+// none has been configured.
+
+func (cfg TLSConfig) ServerTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := cfg.CertFile, cfg.KeyFile
+	if certFile == "" || keyFile == "" {
+		var err error
+		if certFile, keyFile, err = EnsureDevCertificate(cfg.CertDir); err != nil {
+			return nil, err
+		}
+	}
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}, nil
+}
+
+// CertReloader serves the certificate it loaded last and, at most once
+// per checkInterval, looks at the files' modification times to pick up a
+// renewed certificate. A certificate that fails to load is ignored and the
+// previous one stays in use.
+
+type CertReloader struct {
+	certFile, keyFile string
+	checkInterval     time.Duration
+	mutex             sync.Mutex
+	cert              *tls.Certificate
+	modTime           time.Time
+	lastCheck         time.Time
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	reloader := &CertReloader{certFile: certFile, keyFile: keyFile, checkInterval: 2 * time.Second}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (reloader *CertReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, file := range []string{reloader.certFile, reloader.keyFile} {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+func (reloader *CertReloader) reload() error {
+	modTime := reloader.latestModTime()
+	cert, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return err
+	}
+	reloader.cert, reloader.modTime = &cert, modTime
+	return nil
+}
+
+func (reloader *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	if time.Since(reloader.lastCheck) >= reloader.checkInterval {
+		reloader.lastCheck = time.Now()
+		if reloader.latestModTime().After(reloader.modTime) {
+			if err := reloader.reload(); err != nil {
+				Printfln("Certificate reload failed, keeping previous certificate: %v", err)
+			} else {
+				Printfln("Reloaded certificate from %v", reloader.certFile)
+			}
+		}
+	}
+	return reloader.cert, nil
+}
+
+const (
+	devCAName       = "ca"
+	devLeafName     = "localhost"
+	devLeafValidity = 365 * 24 * time.Hour
+	devCAValidity   = 10 * 365 * 24 * time.Hour
+	devRenewBefore  = 30 * 24 * time.Hour
+)
+
+// EnsureDevCertificate returns the localhost certificate and key in dir,
+// creating them if they are missing or close to expiry. The CA is kept
+// between renewals, so it only has to be trusted by the browser once.
+
+func EnsureDevCertificate(dir string) (certFile, keyFile string, err error) {
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	certFile = filepath.Join(dir, devLeafName+".cer")
+	keyFile = filepath.Join(dir, devLeafName+".key")
+	if leaf, _, loadErr := loadKeyPair(certFile, keyFile); loadErr == nil &&
+		time.Until(leaf.NotAfter) > devRenewBefore {
+		return
+	}
+	caCert, caKey, err := loadOrCreateDevCA(dir)
+	if err != nil {
+		return
+	}
+	Printfln("Generating development certificate in %v (trust %v)", dir,
+		filepath.Join(dir, devCAName+".cer"))
+	err = createDevLeaf(caCert, caKey, certFile, keyFile)
+	return
+}
+
+// loadKeyPair returns the parsed first certificate of a PEM pair along
+// with its private key.
+
+func loadKeyPair(certFile, keyFile string) (*x509.Certificate, interface{}, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	return cert, pair.PrivateKey, err
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func writePEM(path, blockType string, der []byte, mode os.FileMode) error {
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), mode)
+}
+
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(path, "EC PRIVATE KEY", der, 0600)
+}
+
+func loadOrCreateDevCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certFile := filepath.Join(dir, devCAName+".cer")
+	keyFile := filepath.Join(dir, devCAName+".key")
+	if cert, key, err := loadKeyPair(certFile, keyFile); err == nil &&
+		time.Until(cert.NotAfter) > devLeafValidity {
+		if key, ok := key.(*ecdsa.PrivateKey); ok {
+			return cert, key, nil
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "httpserver development CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(devCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return nil, nil, err
+	}
+	return cert, key, writeKey(keyFile, key)
+}
+
+func createDevLeaf(caCert *x509.Certificate, caKey *ecdsa.PrivateKey, certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(devLeafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	// The certificate file holds the chain, leaf first, then the CA.
+	chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})...)
+	if err := writeKey(keyFile, key); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, chain, 0644)
+}
+
+// HSTS tells browsers to use HTTPS for future visits. The header is only
+// sent over HTTPS, as browsers ignore it on plain HTTP responses.
+
+func HSTS(cfg TLSConfig, next http.Handler) http.Handler {
+	if cfg.HSTSMaxAge <= 0 {
+		return next
+	}
+	value := fmt.Sprintf("max-age=%d", int(cfg.HSTSMaxAge.Seconds()))
+	if cfg.HSTSIncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.TLS != nil {
+			writer.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// HTTPSRedirect sends every request to the same host and path on the
+// HTTPS port.
+
+func HTTPSRedirect(httpsPort int) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		host, _, err := net.SplitHostPort(request.Host)
+		if err != nil {
+			host = request.Host
+		}
+		target := "https://" + net.JoinHostPort(host, strconv.Itoa(httpsPort)) + request.URL.Path
+		if len(request.URL.RawQuery) > 0 {
+			target += "?" + request.URL.RawQuery
+		}
+		http.Redirect(writer, request, target, http.StatusTemporaryRedirect)
+	}
+}
+
+// ListenAndServeWithTLS serves handler over HTTPS and redirects plain HTTP
+// requests to it, using the ports and certificates from cfg.
+
+func ListenAndServeWithTLS(cfg TLSConfig, handler http.Handler) error {
+	tlsConfig, err := cfg.ServerTLSConfig()
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Addr:      ":" + strconv.Itoa(cfg.HTTPSPort),
+		Handler:   HSTS(cfg, handler),
+		TLSConfig: tlsConfig,
+		Protocols: TLSProtocols(),
+	}
+	errs := make(chan error, 2)
+	go func() {
+		errs <- server.ListenAndServeTLS("", "")
+	}()
+	go func() {
+		errs <- http.ListenAndServe(":"+strconv.Itoa(cfg.HTTPPort), HTTPSRedirect(cfg.HTTPSPort))
+	}()
+	err = <-errs
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	maxUploadSize   = 10 << 20 // whole request body, files included
+	maxUploadMemory = 1 << 20  // parts larger than this are spooled to disk
+)
+
+// Only content that http.DetectContentType recognises as one of these
+// types is accepted, whatever the browser claims in the part header. The
+// stored file gets the extension that goes with the sniffed type, so a
+// text file called evil.html is saved, and later served, as .txt.
+
+var allowedUploadTypes = map[string]string{
+	"image/png":                 ".png",
+	"image/jpeg":                ".jpg",
+	"image/gif":                 ".gif",
+	"application/pdf":           ".pdf",
+	"text/plain; charset=utf-8": ".txt",
+}
+
+type UploadedFile struct {
+	Name string
+	Size int64
+}
+
+type UploadResult struct {
+	Files  []UploadedFile
+	Errors []string
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// uniqueFileName keeps a readable, sanitised version of the client's file
+// name but prefixes it with random bytes, so uploads never overwrite each
+// other and can't escape the upload folder. The client's extension is
+// replaced with ext.
+
+func uniqueFileName(clientName, ext string) (string, error) {
+	prefix := make([]byte, 8)
+	if _, err := rand.Read(prefix); err != nil {
+		return "", err
+	}
+	base := unsafeNameChars.ReplaceAllString(filepath.Base(filepath.Clean("/"+clientName)), "_")
+	if base == "" || base == "." || base == "/" || base == "_" {
+		base = "upload"
+	}
+	if trimmed := strings.TrimSuffix(base, filepath.Ext(base)); trimmed != "" {
+		base = trimmed
+	}
+	return hex.EncodeToString(prefix) + "-" + base + ext, nil
+}
+
+func sniffContentType(file multipart.File) (string, error) {
+	buffer := make([]byte, 512)
+	count, err := io.ReadFull(file, buffer)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buffer[:count]), nil
+}
+
+func saveUploadedFile(uploadDir string, header *multipart.FileHeader) (UploadedFile, error) {
+	file, err := header.Open()
+	if err != nil {
+		return UploadedFile{}, err
+	}
+	defer file.Close()
+
+	contentType, err := sniffContentType(file)
+	if err != nil {
+		return UploadedFile{}, err
+	}
+	ext, ok := allowedUploadTypes[contentType]
+	if !ok {
+		return UploadedFile{}, fmt.Errorf("%v: content type %v is not allowed", header.Filename, contentType)
+	}
+
+	name, err := uniqueFileName(header.Filename, ext)
+	if err != nil {
+		return UploadedFile{}, err
+	}
+	target, err := os.OpenFile(filepath.Join(uploadDir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return UploadedFile{}, err
+	}
+	size, err := io.Copy(target, file)
+	if closeErr := target.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(target.Name())
+		return UploadedFile{}, err
+	}
+	return UploadedFile{Name: name, Size: size}, nil
+}
+
+func listUploadedFiles(uploadDir string) ([]UploadedFile, error) {
+	entries, err := os.ReadDir(uploadDir)
+	if err != nil {
+		return nil, err
+	}
+	files := []UploadedFile{}
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && info.Mode().IsRegular() {
+			files = append(files, UploadedFile{Name: entry.Name(), Size: info.Size()})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+// handleUploads stores the files from a POST and, for both GET and POST,
+// shows everything in the upload folder.
+
+func (s *Server) handleUploads(writer http.ResponseWriter, request *http.Request) {
+	result := UploadResult{}
+	if request.Method == http.MethodPost {
+		if err := request.ParseMultipartForm(maxUploadMemory); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(writer, "Upload exceeds the size limit", http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(writer, err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+		defer request.MultipartForm.RemoveAll()
+		for _, header := range request.MultipartForm.File["files"] {
+			if _, err := saveUploadedFile(s.cfg.UploadDir, header); err != nil {
+				result.Errors = append(result.Errors, err.Error())
+			}
+		}
+	}
+	var err error
+	if result.Files, err = listUploadedFiles(s.cfg.UploadDir); err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.templates.Render(writer, "uploads.html", s.newContext(writer, request, result))
+}
+
+// serveUpload sends a stored upload as a download. The content type is
+// sniffed again rather than taken from the name, the browser is told not
+// to second-guess it, and nothing is ever rendered inline on this origin.
+// There is no directory listing.
+
+func (s *Server) serveUpload(writer http.ResponseWriter, request *http.Request) {
+	name := request.PathValue("name")
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		http.NotFound(writer, request)
+		return
+	}
+	file, err := os.Open(filepath.Join(s.cfg.UploadDir, name))
+	if err != nil {
+		http.NotFound(writer, request)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(writer, request)
+		return
+	}
+	contentType, err := sniffContentType(file)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, ok := allowedUploadTypes[contentType]; !ok {
+		contentType = "application/octet-stream"
+	}
+	writer.Header().Set("Content-Type", contentType)
+	writer.Header().Set("X-Content-Type-Options", "nosniff")
+	writer.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": name}))
+	http.ServeContent(writer, request, name, info.ModTime(), file)
+}
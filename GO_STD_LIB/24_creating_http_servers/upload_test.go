@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func multipartHeader(t *testing.T, filename, content string) *multipart.FileHeader {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("files", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(content))
+	writer.Close()
+	form, err := multipart.NewReader(&body, writer.Boundary()).ReadForm(maxUploadMemory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { form.RemoveAll() })
+	return form.File["files"][0]
+}
+
+func TestUploadedHTMLIsNotServedAsHTML(t *testing.T) {
+	cfg := testConfig(t)
+	server := newTestServer(t, cfg)
+	saved, err := saveUploadedFile(cfg.UploadDir,
+		multipartHeader(t, "evil.html", "hi <script>alert(1)</script>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(saved.Name, "-evil.txt") {
+		t.Errorf("stored as %v, want the sniffed .txt extension", saved.Name)
+	}
+
+	response := serve(server, httptest.NewRequest("GET", "/files/uploads/"+saved.Name, nil))
+	if response.Code != http.StatusOK {
+		t.Fatalf("status = %v", response.Code)
+	}
+	headers := response.Header()
+	if got := headers.Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if got := headers.Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("X-Content-Type-Options = %q", got)
+	}
+	if got := headers.Get("Content-Disposition"); !strings.HasPrefix(got, "attachment") {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+}
+
+func TestUploadRejectsUnknownTypes(t *testing.T) {
+	_, err := saveUploadedFile(t.TempDir(), multipartHeader(t, "page.html",
+		"<!DOCTYPE html><html><script>alert(1)</script></html>"))
+	if err == nil {
+		t.Error("HTML content was accepted")
+	}
+}
+
+func TestUploadsAreNotListed(t *testing.T) {
+	cfg := testConfig(t)
+	server := newTestServer(t, cfg)
+	if _, err := saveUploadedFile(cfg.UploadDir, multipartHeader(t, "a.txt", "hello")); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/files/uploads/", "/files/uploads/..%2fserver.go", "/files/uploads/.hidden"} {
+		if response := serve(server, httptest.NewRequest("GET", path, nil)); response.Code != http.StatusNotFound {
+			t.Errorf("%v: status = %v, want 404", path, response.Code)
+		}
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// This file implements just enough of RFC 6455 for the /ws endpoint:
+// the opening handshake, text frames in both directions, fragmented
+// messages from the client, and the ping, pong and close control frames.
+
+const (
+	wsGUID           = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	wsMaxMessageSize = 64 << 10
+	wsWriteWait      = 10 * time.Second
+	wsPongWait       = 60 * time.Second
+	wsPingPeriod     = wsPongWait * 9 / 10
+	wsSendBuffer     = 32
+
+	wsCloseNormal      = 1000
+	wsCloseProtocol    = 1002
+	wsCloseTooBig      = 1009
+	wsClosePolicy      = 1008
+	wsCloseUnsupported = 1003
+	wsCloseInvalidData = 1007
+)
+
+var errWSClosed = errors.New("websocket closed by peer")
+
+type wsCloseError struct {
+	code   int
+	reason string
+}
+
+func (e *wsCloseError) Error() string {
+	return e.reason
+}
+
+// wsConn is a hijacked connection speaking the WebSocket framing. Reads
+// happen on one goroutine; writes are serialised by the mutex, because
+// pongs are written by the reader while messages are written by the writer.
+
+type wsConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	mutex  sync.Mutex
+}
+
+func wsAcceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeWebSocket checks the handshake, hijacks the connection and sends
+// the 101 response. Errors are written to the client before returning.
+
+func upgradeWebSocket(writer http.ResponseWriter, request *http.Request) (*wsConn, error) {
+	if !headerHasToken(request.Header, "Connection", "upgrade") ||
+		!headerHasToken(request.Header, "Upgrade", "websocket") {
+		http.Error(writer, "Expected a WebSocket upgrade", http.StatusBadRequest)
+		return nil, errors.New("not a websocket handshake")
+	}
+	if request.Header.Get("Sec-WebSocket-Version") != "13" {
+		writer.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(writer, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported websocket version")
+	}
+	key := request.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(writer, "Invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("invalid websocket key")
+	}
+	conn, buffered, err := http.NewResponseController(writer).Hijack()
+	if err != nil {
+		http.Error(writer, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, err
+	}
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n\r\n"
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, reader: buffered.Reader}, nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	header := []byte{0x80 | opcode}
+	switch length := len(payload); {
+	case length < 126:
+		header = append(header, byte(length))
+	case length <= 0xFFFF:
+		header = append(header, 126, byte(length>>8), byte(length))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *wsConn) writeClose(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return c.writeFrame(wsOpClose, append(payload, reason...))
+}
+
+// readFrame reads one frame and unmasks its payload. Client frames must
+// be masked and control frames must be short and unfragmented.
+
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.reader, head[:]); err != nil {
+		return
+	}
+	fin, opcode = head[0]&0x80 != 0, head[0]&0x0F
+	if head[0]&0x70 != 0 {
+		err = &wsCloseError{wsCloseProtocol, "reserved bits set"}
+		return
+	}
+	if head[1]&0x80 == 0 {
+		err = &wsCloseError{wsCloseProtocol, "client frames must be masked"}
+		return
+	}
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err = io.ReadFull(c.reader, extended[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err = io.ReadFull(c.reader, extended[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if opcode >= wsOpClose && (length > 125 || !fin) {
+		err = &wsCloseError{wsCloseProtocol, "invalid control frame"}
+		return
+	}
+	if length > wsMaxMessageSize {
+		err = &wsCloseError{wsCloseTooBig, "message too big"}
+		return
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// ReadMessage returns the next complete text message, assembling
+// fragments and answering control frames along the way. onPong is called
+// for every pong, so the caller can extend its read deadline.
+
+func (c *wsConn) ReadMessage(onPong func()) ([]byte, error) {
+	var message []byte
+	started := false
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			onPong()
+			continue
+		case wsOpClose:
+			code := wsCloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.writeClose(code, "")
+			return nil, errWSClosed
+		case wsOpText:
+			if started {
+				return nil, &wsCloseError{wsCloseProtocol, "expected continuation frame"}
+			}
+			started = true
+		case wsOpContinuation:
+			if !started {
+				return nil, &wsCloseError{wsCloseProtocol, "unexpected continuation frame"}
+			}
+		case wsOpBinary:
+			return nil, &wsCloseError{wsCloseUnsupported, "binary messages are not supported"}
+		default:
+			return nil, &wsCloseError{wsCloseProtocol, "unknown opcode"}
+		}
+		if len(message)+len(payload) > wsMaxMessageSize {
+			return nil, &wsCloseError{wsCloseTooBig, "message too big"}
+		}
+		message = append(message, payload...)
+		if fin {
+			if !utf8.Valid(message) {
+				return nil, &wsCloseError{wsCloseInvalidData, "text message is not valid UTF-8"}
+			}
+			return message, nil
+		}
+	}
+}
+
+// wsRequest is a message from the client, such as
+// {"action": "subscribe", "category": "Chess"}. The category "*" stands
+// for every category.
+
+type wsRequest struct {
+	Action   string
+	Category string
+}
+
+type wsMessage struct {
+	Type       string
+	Event      *ProductEvent `json:",omitempty"`
+	Categories []string      `json:",omitempty"`
+	Error      string        `json:",omitempty"`
+}
+
+// wsClient is one connection to /ws. Messages for it are queued in send,
+// which is drained by its own writer goroutine; a client that lets send
+// fill up is disconnected instead of holding up the others.
+
+type wsClient struct {
+	conn       *wsConn
+	send       chan []byte
+	mutex      sync.Mutex
+	categories map[string]bool
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+func (c *wsClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.conn.Close()
+	})
+}
+
+func (c *wsClient) wants(category string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.categories["*"] || c.categories[category]
+}
+
+func (c *wsClient) subscribed() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	categories := []string{}
+	for category := range c.categories {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	return categories
+}
+
+// queue hands a message to the writer without blocking, reporting false
+// when the client is too far behind to take it.
+
+func (c *wsClient) queue(message wsMessage) bool {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return true
+	}
+	select {
+	case c.send <- data:
+		return true
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *wsClient) writeLoop() {
+	ping := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ping.Stop()
+		c.close()
+	}()
+	for {
+		select {
+		case <-c.done:
+			return
+		case data := <-c.send:
+			if c.conn.writeFrame(wsOpText, data) != nil {
+				return
+			}
+		case <-ping.C:
+			if c.conn.writeFrame(wsOpPing, nil) != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *wsClient) readLoop() {
+	defer c.close()
+	extend := func() { c.conn.conn.SetReadDeadline(time.Now().Add(wsPongWait)) }
+	extend()
+	for {
+		data, err := c.conn.ReadMessage(extend)
+		if err != nil {
+			var closeErr *wsCloseError
+			if errors.As(err, &closeErr) {
+				c.conn.writeClose(closeErr.code, closeErr.reason)
+			}
+			return
+		}
+		extend()
+		var request wsRequest
+		if err := json.Unmarshal(data, &request); err != nil || request.Category == "" {
+			c.queue(wsMessage{Type: "error", Error: "expected {\"action\": ..., \"category\": ...}"})
+			continue
+		}
+		c.mutex.Lock()
+		switch request.Action {
+		case "subscribe":
+			c.categories[request.Category] = true
+		case "unsubscribe":
+			delete(c.categories, request.Category)
+		}
+		c.mutex.Unlock()
+		if request.Action != "subscribe" && request.Action != "unsubscribe" {
+			c.queue(wsMessage{Type: "error", Error: "unknown action " + request.Action})
+			continue
+		}
+		c.queue(wsMessage{Type: "subscriptions", Categories: c.subscribed()})
+	}
+}
+
+// sameOriginOrAllowed stops other sites' pages from opening a socket with
+// the user's cookies, unless CORS allows that origin.
+
+func (s *Server) sameOriginOrAllowed(request *http.Request) bool {
+	origin := request.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if parsed, err := url.Parse(origin); err == nil && strings.EqualFold(parsed.Host, request.Host) {
+		return true
+	}
+	return s.cors.originAllowed(origin)
+}
+
+// handleWebSocket sends product events for the categories the client has
+// subscribed to. A new connection is subscribed to nothing; it sends
+// {"action": "subscribe", "category": "*"} to receive every change. A
+// product moved between categories is reported to both of them.
+
+func (s *Server) handleWebSocket(writer http.ResponseWriter, request *http.Request) {
+	if !s.sameOriginOrAllowed(request) {
+		http.Error(writer, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	conn, err := upgradeWebSocket(writer, request)
+	if err != nil {
+		return
+	}
+	client := &wsClient{
+		conn:       conn,
+		send:       make(chan []byte, wsSendBuffer),
+		categories: map[string]bool{},
+		done:       make(chan struct{}),
+	}
+	sub := s.events.Subscribe(0)
+	defer sub.Close()
+
+	go client.writeLoop()
+	go client.readLoop()
+
+	for {
+		select {
+		case <-client.done:
+			return
+		case event, open := <-sub.Events:
+			if !open {
+				client.conn.writeClose(wsClosePolicy, "too slow")
+				client.close()
+				return
+			}
+			if !client.wants(event.Product.Category) &&
+				(event.PreviousCategory == "" || !client.wants(event.PreviousCategory)) {
+				continue
+			}
+			if !client.queue(wsMessage{Type: "event", Event: &event}) {
+				client.conn.writeClose(wsClosePolicy, "too slow")
+				client.close()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The key and accept value from the example in RFC 6455, section 1.3.
+
+const (
+	wsTestKey    = "dGhlIHNhbXBsZSBub25jZQ=="
+	wsTestAccept = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+)
+
+// wsTestClient speaks the client side of the framing over a raw
+// connection, so tests can send frames a well-behaved client wouldn't.
+
+type wsTestClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialWebSocket(t *testing.T, server *httptest.Server, header string) (*wsTestClient, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	request := "GET /ws HTTP/1.1\r\nHost: " + server.Listener.Addr().String() + "\r\n" + header + "\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &wsTestClient{t: t, conn: conn, reader: reader}, response
+}
+
+func openWebSocket(t *testing.T, server *httptest.Server) *wsTestClient {
+	t.Helper()
+	client, response := dialWebSocket(t, server, "Connection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: "+wsTestKey+"\r\n")
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake status %d", response.StatusCode)
+	}
+	return client
+}
+
+func (c *wsTestClient) send(masked bool, opcode byte, payload []byte) {
+	c.t.Helper()
+	frame := []byte{0x80 | opcode, byte(len(payload))}
+	if masked {
+		mask := []byte{0x12, 0x34, 0x56, 0x78}
+		frame[1] |= 0x80
+		frame = append(frame, mask...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// receive reads the next frame from the server, which must be unmasked.
+
+func (c *wsTestClient) receive() (opcode byte, payload []byte) {
+	c.t.Helper()
+	var head [2]byte
+	if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	if head[1]&0x80 != 0 {
+		c.t.Fatal("server frame is masked")
+	}
+	length := int(head[1] & 0x7F)
+	if length == 126 {
+		var extended [2]byte
+		io.ReadFull(c.reader, extended[:])
+		length = int(binary.BigEndian.Uint16(extended[:]))
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		c.t.Fatal(err)
+	}
+	return head[0] & 0x0F, payload
+}
+
+func (c *wsTestClient) receiveMessage() wsMessage {
+	c.t.Helper()
+	for {
+		opcode, payload := c.receive()
+		if opcode == wsOpPing {
+			continue
+		}
+		if opcode != wsOpText {
+			c.t.Fatalf("opcode %#x, want a text message", opcode)
+		}
+		var message wsMessage
+		if err := json.Unmarshal(payload, &message); err != nil {
+			c.t.Fatal(err)
+		}
+		return message
+	}
+}
+
+// expectClose checks the server closes with code and then drops the
+// connection.
+
+func (c *wsTestClient) expectClose(code int) {
+	c.t.Helper()
+	opcode, payload := c.receive()
+	if opcode != wsOpClose || len(payload) < 2 {
+		c.t.Fatalf("got opcode %#x %q, want a close frame", opcode, payload)
+	}
+	if got := int(binary.BigEndian.Uint16(payload)); got != code {
+		c.t.Errorf("close code %d (%q), want %d", got, payload[2:], code)
+	}
+	if _, err := c.reader.ReadByte(); err != io.EOF {
+		c.t.Errorf("connection still open after close: %v", err)
+	}
+}
+
+func newWebSocketServer(t *testing.T) (*Server, *httptest.Server) {
+	server := newTestServer(t, testConfig(t))
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	return server, httpServer
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	_, httpServer := newWebSocketServer(t)
+	client, response := dialWebSocket(t, httpServer, "Connection: keep-alive, Upgrade\r\n"+
+		"Upgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: "+wsTestKey+"\r\n")
+	if response.StatusCode != http.StatusSwitchingProtocols ||
+		response.Header.Get("Sec-WebSocket-Accept") != wsTestAccept ||
+		!strings.EqualFold(response.Header.Get("Upgrade"), "websocket") {
+		t.Fatalf("response %d %v", response.StatusCode, response.Header)
+	}
+	client.send(true, wsOpPing, []byte("hi"))
+	if opcode, payload := client.receive(); opcode != wsOpPong || string(payload) != "hi" {
+		t.Errorf("ping answered with %#x %q", opcode, payload)
+	}
+
+	tests := map[string]struct {
+		header string
+		status int
+	}{
+		"no upgrade": {"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: " + wsTestKey + "\r\n",
+			http.StatusBadRequest},
+		"old version": {"Connection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 8\r\n" +
+			"Sec-WebSocket-Key: " + wsTestKey + "\r\n", http.StatusUpgradeRequired},
+		"bad key": {"Connection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\n" +
+			"Sec-WebSocket-Key: c2hvcnQ=\r\n", http.StatusBadRequest},
+		"other origin": {"Connection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\n" +
+			"Sec-WebSocket-Key: " + wsTestKey + "\r\nOrigin: http://evil.example\r\n", http.StatusForbidden},
+	}
+	for name, test := range tests {
+		if _, response := dialWebSocket(t, httpServer, test.header); response.StatusCode != test.status {
+			t.Errorf("%v: status %d, want %d", name, response.StatusCode, test.status)
+		}
+	}
+}
+
+func TestWebSocketMasking(t *testing.T) {
+	_, httpServer := newWebSocketServer(t)
+	client := openWebSocket(t, httpServer)
+	client.send(true, wsOpText, []byte(`{"action": "subscribe", "category": "Chess"}`))
+	if message := client.receiveMessage(); message.Type != "subscriptions" ||
+		len(message.Categories) != 1 || message.Categories[0] != "Chess" {
+		t.Errorf("masked subscribe answered with %+v", message)
+	}
+
+	client.send(false, wsOpText, []byte(`{"action": "subscribe", "category": "Soccer"}`))
+	client.expectClose(wsCloseProtocol)
+}
+
+func TestWebSocketCloseHandshake(t *testing.T) {
+	_, httpServer := newWebSocketServer(t)
+	client := openWebSocket(t, httpServer)
+	client.send(true, wsOpClose, binary.BigEndian.AppendUint16(nil, wsCloseNormal))
+	client.expectClose(wsCloseNormal)
+}
+
+func TestWebSocketInvalidUTF8(t *testing.T) {
+	_, httpServer := newWebSocketServer(t)
+	client := openWebSocket(t, httpServer)
+	client.send(true, wsOpText, []byte("{\"category\": \"\xff\xfe\"}"))
+	client.expectClose(wsCloseInvalidData)
+}
+
+func TestWebSocketCategoryMove(t *testing.T) {
+	server, httpServer := newWebSocketServer(t)
+	client := openWebSocket(t, httpServer)
+	client.send(true, wsOpText, []byte(`{"action": "subscribe", "category": "Watersports"}`))
+	client.receiveMessage()
+
+	moved := Product{Name: "Kayak", Category: "Chess", Price: 279}
+	if _, err := server.repo.Update(1, moved); err != nil {
+		t.Fatal(err)
+	}
+	message := client.receiveMessage()
+	if message.Type != "event" || message.Event.Product != moved ||
+		message.Event.PreviousCategory != "Watersports" {
+		t.Fatalf("old category got %+v", message)
+	}
+
+	// A later update within Chess isn't news for Watersports.
+	server.repo.Update(1, Product{Name: "Kayak", Category: "Chess", Price: 300})
+	server.repo.Update(2, Product{Name: "Lifejacket", Category: "Watersports", Price: 50})
+	if message := client.receiveMessage(); message.Event.ProductID != 2 {
+		t.Errorf("got event for product %d, want 2", message.Event.ProductID)
+	}
+}